@@ -4,16 +4,21 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// CodeOffsetOutOfRange is ErrOffsetOutOfRange's status code. It isn't one of
+// gRPC's codes, which clients have come to depend on.
+const CodeOffsetOutOfRange codes.Code = 404
+
 type ErrOffsetOutOfRange struct {
 	Offset uint64
 }
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 	st := status.New(
-		404,
+		CodeOffsetOutOfRange,
 		fmt.Sprintf("offset out of range: %d", e.Offset),
 	)
 	msg := fmt.Sprintf(
@@ -34,3 +39,63 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrStaleSequence is returned for a sequence that isn't past its producer's
+// last sequence but isn't one of those remembered, so whether it was appended
+// isn't known: it may have been rejected while later sequences were appended.
+// Producers resume after LastSequence once they've checked what they appended.
+type ErrStaleSequence struct {
+	ProducerID   string
+	Sequence     uint64
+	LastSequence uint64
+}
+
+func (e ErrStaleSequence) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"sequence %d of producer %q is out of order: its last sequence is %d",
+			e.Sequence,
+			e.ProducerID,
+			e.LastSequence,
+		),
+	)
+}
+
+func (e ErrStaleSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTxnNotOpen struct {
+	TxnID uint64
+}
+
+func (e ErrTxnNotOpen) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction %d isn't open", e.TxnID),
+	)
+}
+
+func (e ErrTxnNotOpen) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordNotCommitted is returned to read committed consumers for
+// transaction markers and records of transactions that are open or aborted.
+type ErrRecordNotCommitted struct {
+	Offset uint64
+	// Open is set if the record's transaction may still commit.
+	Open bool
+}
+
+func (e ErrRecordNotCommitted) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("record at offset %d isn't committed", e.Offset),
+	)
+}
+
+func (e ErrRecordNotCommitted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
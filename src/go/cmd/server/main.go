@@ -1,12 +1,144 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/server"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/agent"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/authn"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/config"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	hostname, _ := os.Hostname()
+	var (
+		dataDir        = flag.String("data-dir", "/var/run/proglog", "directory to store the log and Raft data in")
+		nodeName       = flag.String("node-name", hostname, "unique server id")
+		bindAddr       = flag.String("bind-addr", "127.0.0.1:8401", "address to bind Serf on")
+		rpcPort        = flag.Int("rpc-port", 8400, "port for RPC clients, the HTTP API and Raft connections")
+		startJoinAddrs = flag.String("start-join-addrs", "", "comma separated Serf addresses to join")
+		bootstrap      = flag.Bool("bootstrap", false, "bootstrap the cluster")
+		aclModelFile   = flag.String("acl-model-file", config.ACLModelFile, "path to the ACL model")
+		aclPolicyFile  = flag.String("acl-policy-file", config.ACLPolicyFile, "path to the ACL policy, reread when it changes and on SIGHUP")
+		serverCertFile = flag.String("server-tls-cert-file", "", "path to the server certificate")
+		serverKeyFile  = flag.String("server-tls-key-file", "", "path to the server key")
+		serverCAFile   = flag.String("server-tls-ca-file", "", "path to the CA for client certificates")
+		serverCRLFile  = flag.String("server-tls-crl-file", "", "path to the CRLs of revoked client certificates, reread when it changes")
+		peerCertFile   = flag.String("peer-tls-cert-file", "", "path to the certificate for connecting to peers")
+		peerKeyFile    = flag.String("peer-tls-key-file", "", "path to the key for connecting to peers")
+		peerCAFile     = flag.String("peer-tls-ca-file", "", "path to the CA for peer certificates")
+		peerCRLFile    = flag.String("peer-tls-crl-file", "", "path to the CRLs of revoked peer certificates, reread when it changes")
+		peerServerName = flag.String("peer-tls-server-name", "", "name peer certificates are verified against, required when peers are dialed by IP address")
+		replicatedACL  = flag.Bool("replicated-acl", false, "enforce the ACL policy replicated with the log, seeded from the bootstrap node's policy file")
+		enforceSchemas = flag.Bool("enforce-schemas", false, "reject records that aren't valid with their schema")
+		auditFile      = flag.String("audit-file", "", "path to a rotated file to record authorization decisions and admin operations to")
+		auditLog       = flag.Bool("audit-log", false, "record authorization decisions and admin operations to a commit log in the data dir")
+		auditReadRate  = flag.Float64("audit-read-sample-rate", 1, "fraction of allowed reads to audit")
+		quotaFile      = flag.String("quota-file", "", "path to the JSON client quotas, reread on SIGHUP")
+		authenticators = flag.String("authenticators", "cert", "comma separated authenticators to identify clients with, in order: cert, san, spiffe or jwt")
+		spiffeDomain   = flag.String("spiffe-trust-domain", "", "trust domain SPIFFE IDs must be in")
+		jwksFile       = flag.String("jwt-jwks-file", "", "path to the JWKS bearer tokens are verified with, reread when it changes")
+		jwtIssuer      = flag.String("jwt-issuer", "", "issuer bearer tokens must have")
+		jwtAudience    = flag.String("jwt-audience", "", "audience bearer tokens must have")
+		mirrorAddr     = flag.String("mirror-source-addr", "", "RPC address of another cluster whose log the leader mirrors")
+		mirrorOffsets  = flag.Bool("mirror-preserve-offsets", false, "stop mirroring rather than let mirrored records land at different offsets")
+		mirrorCertFile = flag.String("mirror-tls-cert-file", "", "path to the certificate for connecting to the mirror's source")
+		mirrorKeyFile  = flag.String("mirror-tls-key-file", "", "path to the key for connecting to the mirror's source")
+		mirrorCAFile   = flag.String("mirror-tls-ca-file", "", "path to the CA for the mirror's source's certificate")
+		mirrorName     = flag.String("mirror-tls-server-name", "", "name the mirror's source's certificate is verified against, defaulting to its address's host")
+	)
+	flag.Parse()
+
+	cfg := agent.Config{
+		DataDir:               *dataDir,
+		NodeName:              *nodeName,
+		BindAddr:              *bindAddr,
+		RPCPort:               *rpcPort,
+		Bootstrap:             *bootstrap,
+		ACLModelFile:          *aclModelFile,
+		ACLPolicyFile:         *aclPolicyFile,
+		ReplicatedACL:         *replicatedACL,
+		EnforceSchemas:        *enforceSchemas,
+		QuotaFile:             *quotaFile,
+		AuditFile:             *auditFile,
+		AuditLog:              *auditLog,
+		AuditReadSampleRate:   *auditReadRate,
+		MirrorSourceAddr:      *mirrorAddr,
+		MirrorPreserveOffsets: *mirrorOffsets,
+		Authenticators:        strings.Split(*authenticators, ","),
+		SPIFFETrustDomain:     *spiffeDomain,
+		JWT: authn.JWTConfig{
+			JWKSFile: *jwksFile,
+			Issuer:   *jwtIssuer,
+			Audience: *jwtAudience,
+		},
+	}
+	if *startJoinAddrs != "" {
+		cfg.StartJoinAddrs = strings.Split(*startJoinAddrs, ",")
+	}
+	var err error
+	cfg.ServerTLSConfig, err = setupTLSConfig(config.TLSConfig{
+		CertFile: *serverCertFile,
+		KeyFile:  *serverKeyFile,
+		CAFile:   *serverCAFile,
+		CRLFile:  *serverCRLFile,
+		Server:   true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.PeerTLSConfig, err = setupTLSConfig(config.TLSConfig{
+		CertFile:      *peerCertFile,
+		KeyFile:       *peerKeyFile,
+		CAFile:        *peerCAFile,
+		CRLFile:       *peerCRLFile,
+		ServerAddress: *peerServerName,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.MirrorTLSConfig, err = setupTLSConfig(config.TLSConfig{
+		CertFile:      *mirrorCertFile,
+		KeyFile:       *mirrorKeyFile,
+		CAFile:        *mirrorCAFile,
+		ServerAddress: *mirrorName,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a, err := agent.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigc {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err = a.ReloadQuotas(); err != nil {
+			log.Printf("failed to reload quotas: %v", err)
+		}
+		if err = a.ReloadACL(); err != nil {
+			log.Printf("failed to reload ACL policy: %v", err)
+		}
+	}
+	if err = a.Shutdown(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setupTLSConfig returns nil when no certificate is configured so the agent
+// runs without TLS.
+func setupTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" {
+		return nil, nil
+	}
+	return config.SetupTLSConfig(cfg)
 }
@@ -6,19 +6,28 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/soheilhy/cmux"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/audit"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/auth"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/authn"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/config"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/discovery"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/log"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/quota"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/server"
 )
 
@@ -36,10 +45,83 @@ type Config struct {
 	// Bootstrap should be set to true when starting the first node of the cluster.
 	StartJoinAddrs []string
 	ACLModelFile   string
-	ACLPolicyFile  string
-	Bootstrap      bool
+	// ACLPolicyFile is reloaded when it changes and by ReloadACL.
+	ACLPolicyFile string
+	Bootstrap     bool
+	// SnapshotInterval, SnapshotThreshold and TrailingLogs tune how often
+	// Raft snapshots the log and how many entries it keeps afterwards. Zero
+	// values keep Raft's defaults.
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+	TrailingLogs      uint64
+	// SnapshotRetain is the number of snapshots kept on disk.
+	SnapshotRetain int
+	// TransportMaxPool and TransportTimeout configure Raft's connections to
+	// its peers.
+	TransportMaxPool int
+	TransportTimeout time.Duration
+	// TxnTimeout is how long a transaction can stay open before it's
+	// aborted. Zero keeps the log's default.
+	TxnTimeout time.Duration
+	// ProduceWindow bounds the produce requests a stream can have in flight.
+	ProduceWindow int
+	// HTTPReadHeaderTimeout bounds how long the HTTP API waits for a
+	// request's headers, and HTTPIdleTimeout how long it keeps idle
+	// connections open. Zero keeps the server's defaults.
+	HTTPReadHeaderTimeout time.Duration
+	HTTPIdleTimeout       time.Duration
+	// MirrorSourceAddr is the RPC address of another cluster whose log this
+	// cluster mirrors. The leader mirrors it, resuming where the previous
+	// leader stopped.
+	MirrorSourceAddr string
+	// MirrorTLSConfig is used to connect to the mirror's source.
+	MirrorTLSConfig *tls.Config
+	// MirrorPreserveOffsets stops the mirror rather than let records land at
+	// offsets other than their source's.
+	MirrorPreserveOffsets bool
+	// EnforceSchemas rejects produced records that aren't valid with the
+	// schema they name in the cluster's schema registry.
+	EnforceSchemas bool
+	// ReplicatedACL enforces the ACL policy replicated with the log, changed
+	// through the UpdatePolicy RPC, rather than the ACLPolicyFile. The
+	// bootstrap node seeds the policy from its ACLPolicyFile.
+	ReplicatedACL bool
+	// QuotaFile is a JSON quota.Config limiting each client's throughput.
+	// ReloadQuotas rereads it.
+	QuotaFile string
+	// AuditFile is a file authorization decisions and admin operations are
+	// recorded to, a JSON event per line, rotated every AuditFileMaxBytes.
+	AuditFile string
+	// AuditLog records the events to a commit log in the DataDir's audit
+	// directory, keeping about the last AuditLogRetain.
+	AuditLog bool
+	// AuditReadSampleRate is the fraction of allowed reads recorded.
+	AuditReadSampleRate float64
+	// Authenticators are tried in order to identify clients: "cert" for
+	// their certificate's common name, "san" for its DNS or email SAN,
+	// "spiffe" for its SPIFFE ID and "jwt" for a bearer token. Just "cert"
+	// by default.
+	Authenticators []string
+	// SPIFFETrustDomain is the trust domain SPIFFE IDs must be in.
+	SPIFFETrustDomain string
+	// JWT configures the "jwt" authenticator.
+	JWT authn.JWTConfig
 }
 
+const (
+	// AuditFileMaxBytes is the size audit files are rotated at.
+	AuditFileMaxBytes = 100 << 20
+	// AuditFileBackups is how many rotated audit files are kept.
+	AuditFileBackups = 5
+	// AuditLogRetain is about how many events the audit log keeps.
+	AuditLogRetain = 1_000_000
+	// AuditLogSegmentEvents and AuditLogSegmentBytes bound the audit log's
+	// segments, so it has a couple of dozen open rather than one for every
+	// few events.
+	AuditLogSegmentEvents = AuditLogRetain / 16
+	AuditLogSegmentBytes  = 64 << 20
+)
+
 func (c Config) RPCAddr() (string, error) {
 	host, _, err := net.SplitHostPort(c.BindAddr)
 	if err != nil {
@@ -53,8 +135,15 @@ type Agent struct {
 
 	mux        cmux.CMux
 	log        *log.DistributedLog
+	apiMux     cmux.CMux
 	server     *grpc.Server
+	httpServer *http.Server
 	membership *discovery.Membership
+	mirror     *log.Mirror
+	mirrorConn *grpc.ClientConn
+	quotas     *quota.Manager
+	auditor    *audit.Auditor
+	authorizer *auth.Authorizer
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -70,8 +159,10 @@ func New(config Config) (*Agent, error) {
 		a.setupMux,
 		a.setupLog,
 		a.setupLogger,
+		a.setupAuditor,
 		a.setupServer,
 		a.setupMembership,
+		a.setupMirror,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
@@ -111,6 +202,13 @@ func (a *Agent) setupLog() error {
 	)
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Raft.SnapshotInterval = a.Config.SnapshotInterval
+	logConfig.Raft.SnapshotThreshold = a.Config.SnapshotThreshold
+	logConfig.Raft.TrailingLogs = a.Config.TrailingLogs
+	logConfig.Raft.SnapshotRetain = a.Config.SnapshotRetain
+	logConfig.Raft.TransportMaxPool = a.Config.TransportMaxPool
+	logConfig.Raft.TransportTimeout = a.Config.TransportTimeout
+	logConfig.TxnTimeout = a.Config.TxnTimeout
 	var err error
 	a.log, err = log.NewDistributedLog(
 		a.Config.DataDir,
@@ -125,34 +223,162 @@ func (a *Agent) setupLog() error {
 	return nil
 }
 
+func (a *Agent) setupAuditor() error {
+	var sinks []audit.Sink
+	if a.Config.AuditFile != "" {
+		file, err := audit.NewFileSink(
+			a.Config.AuditFile,
+			AuditFileMaxBytes,
+			AuditFileBackups,
+		)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, file)
+	}
+	if a.Config.AuditLog {
+		dir := filepath.Join(a.Config.DataDir, "audit")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		c := log.Config{}
+		c.Segment.MaxStoreBytes = AuditLogSegmentBytes
+		c.Segment.MaxIndexBytes = AuditLogSegmentEvents * log.IndexEntryWidth
+		auditLog, err := log.NewLog(dir, c)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, audit.NewLogSink(auditLog, AuditLogRetain))
+	}
+	if len(sinks) > 0 {
+		a.auditor = audit.New(audit.Config{
+			ReadSampleRate: a.Config.AuditReadSampleRate,
+		}, sinks...)
+	}
+	return nil
+}
+
+func (a *Agent) setupAuthorizer() error {
+	if !a.Config.ReplicatedACL {
+		a.authorizer = auth.New(
+			a.Config.ACLModelFile,
+			a.Config.ACLPolicyFile,
+		)
+		return a.authorizer.Watch()
+	}
+	var err error
+	a.authorizer, err = auth.NewReplicated(a.Config.ACLModelFile, a.log)
+	if err != nil {
+		return err
+	}
+	if a.Config.Bootstrap && a.Config.ACLPolicyFile != "" {
+		return a.authorizer.BootstrapPolicy(a.Config.ACLPolicyFile)
+	}
+	return nil
+}
+
+func (a *Agent) setupAuthenticator() (authn.Authenticator, error) {
+	var chain authn.Chain
+	for _, name := range a.Config.Authenticators {
+		switch name {
+		case "cert":
+			chain = append(chain, authn.Certificate{})
+		case "san":
+			chain = append(chain, authn.Certificate{SAN: true})
+		case "spiffe":
+			chain = append(chain, authn.SPIFFE{
+				TrustDomain: a.Config.SPIFFETrustDomain,
+			})
+		case "jwt":
+			tokens, err := authn.NewJWT(a.Config.JWT)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, tokens)
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+	}
+	if len(chain) == 0 {
+		return authn.Certificate{}, nil
+	}
+	return chain, nil
+}
+
 func (a *Agent) setupServer() error {
-	authorizer := auth.New(
-		a.Config.ACLModelFile,
-		a.Config.ACLPolicyFile,
-	)
+	if err := view.Register(config.TLSViews...); err != nil {
+		return err
+	}
+	if err := a.setupAuthorizer(); err != nil {
+		return err
+	}
+	authenticator, err := a.setupAuthenticator()
+	if err != nil {
+		return err
+	}
+	if a.Config.QuotaFile != "" {
+		quotas, err := quota.Load(a.Config.QuotaFile)
+		if err != nil {
+			return err
+		}
+		a.quotas = quota.New(quotas)
+	}
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:             a.log,
+		Authenticator:         authenticator,
+		Authorizer:            a.authorizer,
+		GetServerer:           a.log,
+		ProduceWindow:         a.Config.ProduceWindow,
+		ShuttingDown:          a.shutdowns,
+		EnforceSchemas:        a.Config.EnforceSchemas,
+		Quotas:                a.quotas,
+		Auditor:               a.auditor,
+		HTTPReadHeaderTimeout: a.Config.HTTPReadHeaderTimeout,
+		HTTPIdleTimeout:       a.Config.HTTPIdleTimeout,
 	}
+	// TLS is terminated here rather than by the gRPC server so the decrypted
+	// connections can be split between gRPC and the HTTP API
+	ln := a.mux.Match(cmux.Any())
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
-		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
-		opts = append(opts, grpc.Creds(creds))
+		tlsConfig := config.WithNextProtos(
+			a.Config.ServerTLSConfig, "h2", "http/1.1",
+		)
+		ln = tls.NewListener(ln, tlsConfig)
+		opts = append(opts, grpc.Creds(server.TerminatedTLS()))
 	}
-	var err error
 	a.server, err = server.NewGRPCServer(serverConfig, opts...)
 	if err != nil {
 		return err
 	}
+	a.httpServer, err = server.NewHTTPServer(serverConfig)
+	if err != nil {
+		return err
+	}
 
-	grpcLn := a.mux.Match(cmux.Any())
+	a.apiMux = cmux.New(ln)
+	grpcLn := a.apiMux.MatchWithWriters(
+		cmux.HTTP2MatchHeaderFieldPrefixSendSettings(
+			"content-type",
+			"application/grpc",
+		),
+	)
+	httpLn := a.apiMux.Match(cmux.Any())
 	go func() {
 		if err := a.server.Serve(grpcLn); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
-	return err
+	go func() {
+		err := server.ServeHTTP(a.httpServer, httpLn)
+		if err != nil && err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+	go func() {
+		_ = a.apiMux.Serve()
+	}()
+	return nil
 }
 
 func (a *Agent) setupMembership() error {
@@ -171,6 +397,49 @@ func (a *Agent) setupMembership() error {
 	return err
 }
 
+func (a *Agent) setupMirror() error {
+	if a.Config.MirrorSourceAddr == "" {
+		return nil
+	}
+	if err := view.Register(log.MirrorViews...); err != nil {
+		return err
+	}
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(a.Config.DataDir, "mirror")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var opts []grpc.DialOption
+	if a.Config.PeerTLSConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(
+			credentials.NewTLS(a.Config.PeerTLSConfig),
+		))
+	}
+	a.mirrorConn, err = grpc.Dial(rpcAddr, opts...)
+	if err != nil {
+		return err
+	}
+	var sourceOpts []grpc.DialOption
+	if a.Config.MirrorTLSConfig != nil {
+		sourceOpts = append(sourceOpts, grpc.WithTransportCredentials(
+			credentials.NewTLS(a.Config.MirrorTLSConfig),
+		))
+	}
+	a.mirror = &log.Mirror{
+		SourceAddr:      a.Config.MirrorSourceAddr,
+		DialOptions:     sourceOpts,
+		LocalServer:     api_gen.NewLogClient(a.mirrorConn),
+		CheckpointFile:  filepath.Join(dir, "checkpoint"),
+		PreserveOffsets: a.Config.MirrorPreserveOffsets,
+		Active:          a.log.IsLeader,
+		LastSequence:    a.log.LastSequence,
+	}
+	return a.mirror.Start()
+}
+
 func (a *Agent) serve() error {
 	if err := a.mux.Serve(); err != nil {
 		_ = a.Shutdown()
@@ -179,6 +448,30 @@ func (a *Agent) serve() error {
 	return nil
 }
 
+// ReloadQuotas rereads the QuotaFile, applying it without resetting clients'
+// usage.
+func (a *Agent) ReloadQuotas() error {
+	if a.quotas == nil {
+		return nil
+	}
+	quotas, err := quota.Load(a.Config.QuotaFile)
+	if err != nil {
+		return err
+	}
+	a.quotas.Update(quotas)
+	return nil
+}
+
+// ReloadACL rereads the ACLPolicyFile, keeping the current policy if the new
+// one doesn't load. Replicated policies aren't read from the file.
+func (a *Agent) ReloadACL() error {
+	if a.Config.ReplicatedACL {
+		return nil
+	}
+	_, _, err := a.authorizer.Reload()
+	return err
+}
+
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -189,11 +482,28 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
+		func() error {
+			if a.mirror == nil {
+				return nil
+			}
+			if err := a.mirror.Close(); err != nil {
+				return err
+			}
+			return a.mirrorConn.Close()
+		},
 		a.membership.Leave,
 		func() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		a.httpServer.Close,
+		func() error {
+			if a.auditor == nil {
+				return nil
+			}
+			return a.auditor.Close()
+		},
+		a.authorizer.Close,
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
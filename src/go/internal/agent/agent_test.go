@@ -3,26 +3,208 @@ package agent_test
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 
 	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/agent"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/audit"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/config"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/loadbalance"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/log"
 )
 
 func TestAgent(t *testing.T) {
-	var agents []*agent.Agent
+	agents, peerTLSConfig, teardown := setupAgents(t, 3, nil)
+	defer teardown()
+
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	produceResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	// wait until replication has finished
+	time.Sleep(3 * time.Second)
+
+	consumeResponse, err := leaderClient.Consume(
+		context.Background(),
+		&api_gen.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
+
+	// the HTTP API shares the RPC port
+	rpcAddr, err := agents[0].Config.RPCAddr()
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: peerTLSConfig,
+	}}
+	res, err := httpClient.Get(fmt.Sprintf(
+		"https://%s/v1/records/%d",
+		rpcAddr,
+		produceResponse.Offset,
+	))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	httpResponse := &api_gen.ConsumeResponse{}
+	require.NoError(t, protojson.Unmarshal(b, httpResponse))
+	require.Equal(t, []byte("foo"), httpResponse.Record.Value)
+
+	followerClient := client(t, agents[1], peerTLSConfig)
+	consumeResponse, err = followerClient.Consume(
+		context.Background(),
+		&api_gen.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
+
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api_gen.ConsumeRequest{
+			Offset: produceResponse.Offset + 1,
+		},
+	)
+	require.Nil(t, consumeResponse)
+	require.Error(t, err)
+	got := status.Code(err)
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, got, want)
+}
+
+func TestAgentReplicatedACL(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 3, func(i int, c *agent.Config) {
+		c.ReplicatedACL = true
+		// the bootstrap node seeds the replicated ACL policy
+		if i != 0 {
+			c.ACLPolicyFile = ""
+		}
+	})
+	defer teardown()
+
+	leaderClient := directClient(t, agents[0], peerTLSConfig)
+	produceResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	// followers enforce the policy they were replicated
+	nobodyTLSConfig := clientTLSConfig(t, config.NobodyClientCertFile, config.NobodyClientKeyFile)
+	nobodyClient := directClient(t, agents[1], nobodyTLSConfig)
+	consume := func() error {
+		_, err := nobodyClient.Consume(
+			context.Background(),
+			&api_gen.ConsumeRequest{
+				Offset: produceResponse.Offset,
+			},
+		)
+		return err
+	}
+	require.Equal(t, codes.PermissionDenied, status.Code(consume()))
+
+	// and policy updates made through the leader
+	_, err = leaderClient.UpdatePolicy(
+		context.Background(),
+		&api_gen.UpdatePolicyRequest{
+			Add: []*api_gen.PolicyRule{{
+				Ptype:  "g",
+				Values: []string{"nobody", "consumer"},
+			}},
+		},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return consume() == nil
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestAgentAuditLog(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 1, func(_ int, c *agent.Config) {
+		c.AuditLog = true
+	})
+	defer teardown()
+
+	_, err := directClient(t, agents[0], peerTLSConfig).Produce(
+		context.Background(),
+		&api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	nobodyTLSConfig := clientTLSConfig(t, config.NobodyClientCertFile, config.NobodyClientKeyFile)
+	_, err = directClient(t, agents[0], nobodyTLSConfig).Produce(
+		context.Background(),
+		&api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the decisions are in the audit log once the agent shuts down
+	require.NoError(t, agents[0].Shutdown())
+	auditLog, err := log.NewLog(
+		filepath.Join(agents[0].Config.DataDir, "audit"),
+		log.Config{},
+	)
+	require.NoError(t, err)
+	defer auditLog.Close()
+	var decisions []string
+	for off := uint64(0); off < auditLog.HighWatermark(); off++ {
+		record, err := auditLog.Read(off)
+		require.NoError(t, err)
+		var e audit.Event
+		require.NoError(t, json.Unmarshal(record.Value, &e))
+		if e.Type == audit.Authorization && e.Action == "produce" {
+			decisions = append(decisions, e.Subject+" "+e.Decision)
+		}
+	}
+	require.Equal(t, []string{"root allow", "nobody deny"}, decisions)
+}
+
+// setupAgents starts a cluster of n agents, the first bootstrapping it, and
+// waits for them to join. fn, if set, configures each agent.
+func setupAgents(t *testing.T, n int, fn func(i int, c *agent.Config)) (
+	agents []*agent.Agent,
+	peerTLSConfig *tls.Config,
+	teardown func(),
+) {
+	t.Helper()
 
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
@@ -33,16 +215,9 @@ func TestAgent(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.RootClientCertFile,
-		KeyFile:       config.RootClientKeyFile,
-		CAFile:        config.CAFile,
-		Server:        false,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
+	peerTLSConfig = clientTLSConfig(t, config.RootClientCertFile, config.RootClientKeyFile)
 
-	for i := 0; i < 3; i++ {
+	for i := 0; i < n; i++ {
 		ports := dynaport.Get(2)
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 		rpcPort := ports[1]
@@ -58,7 +233,7 @@ func TestAgent(t *testing.T) {
 			)
 		}
 
-		a, err := agent.New(agent.Config{
+		c := agent.Config{
 			NodeName:        fmt.Sprintf("%d", i),
 			Bootstrap:       i == 0,
 			StartJoinAddrs:  startJoinAddrs,
@@ -69,67 +244,40 @@ func TestAgent(t *testing.T) {
 			ACLPolicyFile:   config.ACLPolicyFile,
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
-		})
+		}
+		if fn != nil {
+			fn(i, &c)
+		}
+		a, err := agent.New(c)
 		require.NoError(t, err)
 
 		agents = append(agents, a)
 	}
-	defer func() {
+
+	// wait until agents have joined the cluster
+	time.Sleep(3 * time.Second)
+
+	return agents, peerTLSConfig, func() {
 		for _, a := range agents {
 			_ = a.Shutdown()
 			require.NoError(t,
 				os.RemoveAll(a.Config.DataDir),
 			)
 		}
-	}()
-
-	// wait until agents have joined the cluster
-	time.Sleep(3 * time.Second)
-
-	leaderClient := client(t, agents[0], peerTLSConfig)
-	produceResponse, err := leaderClient.Produce(
-		context.Background(),
-		&api_gen.ProduceRequest{
-			Record: &api_gen.Record{
-				Value: []byte("foo"),
-			},
-		},
-	)
-	require.NoError(t, err)
-
-	// wait until replication has finished
-	time.Sleep(3 * time.Second)
-
-	consumeResponse, err := leaderClient.Consume(
-		context.Background(),
-		&api_gen.ConsumeRequest{
-			Offset: produceResponse.Offset,
-		},
-	)
-	require.NoError(t, err)
-	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
+	}
+}
 
-	followerClient := client(t, agents[1], peerTLSConfig)
-	consumeResponse, err = followerClient.Consume(
-		context.Background(),
-		&api_gen.ConsumeRequest{
-			Offset: produceResponse.Offset,
-		},
-	)
+func clientTLSConfig(t *testing.T, certFile, keyFile string) *tls.Config {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
 	require.NoError(t, err)
-	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
-
-	consumeResponse, err = leaderClient.Consume(
-		context.Background(),
-		&api_gen.ConsumeRequest{
-			Offset: produceResponse.Offset + 1,
-		},
-	)
-	require.Nil(t, consumeResponse)
-	require.Error(t, err)
-	got := status.Code(err)
-	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
-	require.Equal(t, got, want)
+	return tlsConfig
 }
 
 func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api_gen.LogClient {
@@ -146,3 +294,17 @@ func client(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api_gen.Log
 	client := api_gen.NewLogClient(conn)
 	return client
 }
+
+// directClient connects to just the agent, rather than the servers it
+// resolves to, so calls are made on its connection with its credentials.
+func directClient(t *testing.T, agent *agent.Agent, tlsConfig *tls.Config) api_gen.LogClient {
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		rpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api_gen.NewLogClient(conn)
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Authorization events record an Authorizer's decision.
+	Authorization = "authorization"
+	// Admin events record an admin operation's outcome.
+	Admin = "admin"
+
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Event is an authorization decision or an admin operation.
+type Event struct {
+	Time     time.Time         `json:"time"`
+	Type     string            `json:"type"`
+	Subject  string            `json:"subject"`
+	Action   string            `json:"action"`
+	Object   string            `json:"object"`
+	Decision string            `json:"decision,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Peer     string            `json:"peer,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+	// Read marks authorizations to read, which are sampled when allowed.
+	Read bool `json:"-"`
+}
+
+// Sink stores encoded events.
+type Sink interface {
+	Append(event []byte) error
+	Close() error
+}
+
+type Config struct {
+	// ReadSampleRate is the fraction of allowed reads recorded, from 0 to 1.
+	// Denials, writes and admin operations are always recorded.
+	ReadSampleRate float64
+}
+
+// Auditor records events to its sinks as JSON. Events are queued and
+// written by a single goroutine, so requests don't wait on the sinks' I/O
+// unless the queue is full. Failing to record an event is logged rather than
+// failing the request it's about.
+type Auditor struct {
+	config Config
+	sinks  []Sink
+	logger *zap.Logger
+	events chan []byte
+	done   chan struct{}
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	closed bool
+}
+
+// queueSize is how many encoded events wait for the sinks before Record
+// blocks.
+const queueSize = 1024
+
+func New(config Config, sinks ...Sink) *Auditor {
+	a := &Auditor{
+		config: config,
+		sinks:  sinks,
+		logger: zap.L().Named("audit"),
+		events: make(chan []byte, queueSize),
+		done:   make(chan struct{}),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	go a.write()
+	return a
+}
+
+// write appends queued events to the sinks until the Auditor's closed.
+func (a *Auditor) write() {
+	defer close(a.done)
+	for b := range a.events {
+		for _, sink := range a.sinks {
+			if err := sink.Append(b); err != nil {
+				a.logger.Error("failed to record audit event", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (a *Auditor) Record(e Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	if e.Read && e.Decision == Allow && a.rand.Float64() >= a.config.ReadSampleRate {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		a.logger.Error("failed to encode audit event", zap.Error(err))
+		return
+	}
+	a.events <- b
+}
+
+// Close records the queued events, then closes the sinks. Events recorded
+// after Close are dropped.
+func (a *Auditor) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.events)
+	a.mu.Unlock()
+	<-a.done
+
+	var err error
+	for _, sink := range a.sinks {
+		if closeErr := sink.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/log"
+)
+
+func TestAuditor(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(file, 0, 0)
+	require.NoError(t, err)
+	a := New(Config{ReadSampleRate: 0}, sink)
+
+	a.Record(Event{Type: Authorization, Subject: "root", Action: "consume", Decision: Allow, Read: true})
+	a.Record(Event{Type: Authorization, Subject: "nobody", Action: "consume", Decision: Deny, Read: true})
+	a.Record(Event{Type: Authorization, Subject: "root", Action: "produce", Decision: Allow})
+	a.Record(Event{Type: Admin, Subject: "root", Action: "admin", Object: "acl"})
+	require.NoError(t, a.Close())
+
+	events := readEvents(t, file)
+	require.Len(t, events, 3)
+	require.Equal(t, "nobody", events[0].Subject)
+	require.Equal(t, "produce", events[1].Action)
+	require.Equal(t, Admin, events[2].Type)
+	require.False(t, events[2].Time.IsZero())
+
+	// every allowed read is recorded at a sample rate of one
+	sink, err = NewFileSink(file, 0, 0)
+	require.NoError(t, err)
+	a = New(Config{ReadSampleRate: 1}, sink)
+	for i := 0; i < 10; i++ {
+		a.Record(Event{Type: Authorization, Decision: Allow, Read: true})
+	}
+	require.NoError(t, a.Close())
+	require.Len(t, readEvents(t, file), 13)
+}
+
+func TestAuditorDoesNotWaitOnSinks(t *testing.T) {
+	sink := &blockingSink{unblock: make(chan struct{})}
+	a := New(Config{}, sink)
+
+	// records return while the sink is stuck writing the first event
+	for i := 0; i < 3; i++ {
+		a.Record(Event{Type: Admin, Subject: "root"})
+	}
+	close(sink.unblock)
+	require.NoError(t, a.Close())
+	require.Equal(t, 3, sink.appended)
+	require.True(t, sink.closed)
+
+	// and events recorded once it's closed are dropped
+	a.Record(Event{Type: Admin, Subject: "root"})
+	require.Equal(t, 3, sink.appended)
+}
+
+type blockingSink struct {
+	unblock  chan struct{}
+	appended int
+	closed   bool
+}
+
+func (s *blockingSink) Append([]byte) error {
+	<-s.unblock
+	s.appended++
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	event := []byte(`{"type":"admin"}`)
+	// room for two events a file
+	sink, err := NewFileSink(file, int64(2*(len(event)+1)), 2)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		require.NoError(t, sink.Append(event))
+	}
+	require.NoError(t, sink.Close())
+
+	for _, f := range []string{file, file + ".1", file + ".2"} {
+		b, err := os.ReadFile(f)
+		require.NoError(t, err)
+		require.NotEmpty(t, b)
+	}
+	_, err = os.Stat(file + ".3")
+	require.True(t, os.IsNotExist(err))
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(b), "\n"))
+}
+
+func TestLogSinkRetains(t *testing.T) {
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 3 * 12
+	l, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	sink := NewLogSink(l, 3)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sink.Append([]byte(`{"type":"admin"}`)))
+	}
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(0))
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+	record, err := l.Read(highest)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"admin"}`, string(record.Value))
+	require.NotNil(t, record.Timestamp)
+	require.NoError(t, sink.Close())
+}
+
+func readEvents(t *testing.T, file string) []Event {
+	t.Helper()
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
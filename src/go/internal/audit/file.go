@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileSink writes events to a file a line each, rotating it when it reaches
+// MaxBytes: the file becomes file.1, file.1 becomes file.2 and so on, and
+// the oldest beyond Backups is removed.
+type FileSink struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	file *os.File
+	size int64
+}
+
+func NewFileSink(path string, maxBytes int64, backups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxBytes: maxBytes, backups: backups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *FileSink) Append(event []byte) error {
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(event))+1 > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(append(event, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.backups > 0 {
+		for i := s.backups - 1; i > 0; i-- {
+			err := os.Rename(s.backup(i), s.backup(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
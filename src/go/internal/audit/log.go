@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// CommitLog is a log dedicated to audit events.
+type CommitLog interface {
+	Append(*api_gen.Record) (uint64, error)
+	Truncate(lowest uint64) error
+	Close() error
+}
+
+// LogSink appends events to a commit log as records, keeping about the last
+// Retain of them. The log's whole segments are removed, and only once a
+// sixteenth of Retain more events have been appended, so it can hold that
+// and up to a segment's worth more.
+type LogSink struct {
+	log    CommitLog
+	retain uint64
+	// truncated is the offset the log was last truncated below.
+	truncated uint64
+}
+
+func NewLogSink(log CommitLog, retain uint64) *LogSink {
+	return &LogSink{log: log, retain: retain}
+}
+
+func (s *LogSink) Append(event []byte) error {
+	off, err := s.log.Append(&api_gen.Record{
+		Value:     event,
+		Timestamp: timestamppb.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if s.retain == 0 || off < s.retain {
+		return nil
+	}
+	every := s.retain / 16
+	if every == 0 {
+		every = 1
+	}
+	if lowest := off - s.retain; lowest >= s.truncated+every {
+		s.truncated = lowest
+		return s.log.Truncate(lowest)
+	}
+	return nil
+}
+
+func (s *LogSink) Close() error {
+	return s.log.Close()
+}
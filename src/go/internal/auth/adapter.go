@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+)
+
+// PolicyStore is implemented by stores that replicate the ACL policy between
+// nodes. Each rule is its type, such as p or g, followed by its values.
+type PolicyStore interface {
+	Policy() [][]string
+	UpdatePolicy(add, remove [][]string) error
+	// BootstrapPolicy sets the rules unless the policy has been updated.
+	BootstrapPolicy(rules [][]string) error
+	// NotifyPolicy signals ch, without blocking, after each change to the
+	// policy.
+	NotifyPolicy(ch chan<- struct{})
+}
+
+var _ persist.Adapter = (*storeAdapter)(nil)
+
+// storeAdapter loads casbin's policy from a PolicyStore and saves the rules
+// casbin adds and removes to it.
+type storeAdapter struct {
+	store PolicyStore
+}
+
+func (a *storeAdapter) LoadPolicy(m model.Model) error {
+	for _, rule := range a.store.Policy() {
+		if err := checkRule(m, rule); err != nil {
+			return err
+		}
+		ast := m[rule[0][:1]][rule[0]]
+		ast.Policy = append(ast.Policy, rule[1:])
+	}
+	return nil
+}
+
+func (a *storeAdapter) SavePolicy(model.Model) error {
+	return errors.New("replicated ACL policies are changed rule by rule")
+}
+
+func (a *storeAdapter) AddPolicy(_ string, ptype string, rule []string) error {
+	return a.store.UpdatePolicy([][]string{append([]string{ptype}, rule...)}, nil)
+}
+
+func (a *storeAdapter) RemovePolicy(_ string, ptype string, rule []string) error {
+	return a.store.UpdatePolicy(nil, [][]string{append([]string{ptype}, rule...)})
+}
+
+func (a *storeAdapter) RemoveFilteredPolicy(string, string, int, ...string) error {
+	return errors.New("replicated ACL policies are changed rule by rule")
+}
+
+var _ persist.Adapter = (*bytesAdapter)(nil)
+
+// bytesAdapter loads casbin's policy from a policy file's contents.
+type bytesAdapter struct {
+	policy []byte
+}
+
+func (a *bytesAdapter) LoadPolicy(m model.Model) error {
+	for _, line := range strings.Split(string(a.policy), "\n") {
+		persist.LoadPolicyLine(strings.TrimSpace(line), m)
+	}
+	return nil
+}
+
+func (a *bytesAdapter) SavePolicy(model.Model) error {
+	return errors.New("ACL policy files are changed on disk")
+}
+
+func (a *bytesAdapter) AddPolicy(string, string, []string) error {
+	return errors.New("ACL policy files are changed on disk")
+}
+
+func (a *bytesAdapter) RemovePolicy(string, string, []string) error {
+	return errors.New("ACL policy files are changed on disk")
+}
+
+func (a *bytesAdapter) RemoveFilteredPolicy(string, string, int, ...string) error {
+	return errors.New("ACL policy files are changed on disk")
+}
+
+// checkRule returns an error unless the model defines the rule's type and the
+// rule has a value for each of the type's fields.
+func checkRule(m model.Model, rule []string) error {
+	if len(rule) == 0 || rule[0] == "" {
+		return errors.New("ACL policy rule has no type")
+	}
+	ptype := rule[0]
+	ast, ok := m[ptype[:1]][ptype]
+	if !ok || (ptype[:1] != "p" && ptype[:1] != "g") {
+		return fmt.Errorf("ACL policy rule %q has unknown type %s", ruleString(rule), ptype)
+	}
+	want := len(ast.Tokens)
+	if ptype[:1] == "g" {
+		// role definitions are like "_, _"
+		want = strings.Count(ast.Value, "_")
+	}
+	if len(rule)-1 != want {
+		return fmt.Errorf(
+			"ACL policy rule %q has %d fields, want %d",
+			ruleString(rule),
+			len(rule)-1,
+			want,
+		)
+	}
+	return nil
+}
@@ -1,26 +1,88 @@
 package auth
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/casbin/casbin"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// Authorizer enforces a casbin policy read from a file, or replicated by a
+// PolicyStore.
 type Authorizer struct {
-	enforcer *casbin.Enforcer
+	model    string
+	policy   string
+	store    PolicyStore
+	enforcer atomic.Pointer[casbin.Enforcer]
+	logger   *zap.Logger
+
+	// reloads serializes reloads so their diffs are against the policy they
+	// replace.
+	reloads sync.Mutex
+	// loaded is the policy file's contents when it was last loaded.
+	loaded  []byte
+	watcher *fsnotify.Watcher
+	// changes is signaled when the PolicyStore's policy changes, and done
+	// is closed to stop reloading it.
+	changes chan struct{}
+	done    chan struct{}
 }
 
 func New(model, policy string) *Authorizer {
-	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{enforcer: enforcer}
+	a := &Authorizer{
+		model:  model,
+		policy: policy,
+		logger: zap.L().Named("auth"),
+	}
+	b, err := os.ReadFile(policy)
+	if err != nil {
+		// fails as casbin does for a policy it can't read
+		a.enforcer.Store(casbin.NewEnforcer(model, policy))
+		return a
+	}
+	a.loaded = b
+	a.enforcer.Store(casbin.NewEnforcer(model, &bytesAdapter{policy: b}))
+	return a
+}
+
+// NewReplicated returns an Authorizer enforcing the store's policy, which it
+// reloads in the background whenever the policy changes, until Close is
+// called.
+func NewReplicated(model string, store PolicyStore) (*Authorizer, error) {
+	a := &Authorizer{
+		model:   model,
+		store:   store,
+		logger:  zap.L().Named("auth"),
+		changes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	// a change made while the policy loads is reloaded once it's loaded
+	store.NotifyPolicy(a.changes)
+	enforcer, err := casbin.NewEnforcerSafe(model, &storeAdapter{store: store})
+	if err != nil {
+		return nil, err
+	}
+	a.enforcer.Store(enforcer)
+	go a.watchStore()
+	return a, nil
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	if !a.enforcer.Load().Enforce(subject, object, action) {
 		msg := fmt.Sprintf(
-			"%s is not authorized to %s to %s",
+			"%s is not authorized to %s %s",
 			subject,
 			action,
 			object,
@@ -31,3 +93,248 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 
 	return nil
 }
+
+// Policy returns the enforced policy's rules, each its type followed by its
+// values.
+func (a *Authorizer) Policy() [][]string {
+	return enforcerRules(a.enforcer.Load())
+}
+
+// UpdatePolicy checks the rules are valid with the model and submits them to
+// the PolicyStore, which removes and then adds them. Authorizers reading
+// their policy from a file can't be updated.
+func (a *Authorizer) UpdatePolicy(add, remove [][]string) error {
+	if a.store == nil {
+		return status.Error(
+			codes.FailedPrecondition,
+			"ACL policy is read from a file",
+		)
+	}
+	model := a.enforcer.Load().GetModel()
+	for _, rule := range add {
+		if err := checkRule(model, rule); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return a.store.UpdatePolicy(add, remove)
+}
+
+// BootstrapPolicy seeds the PolicyStore with the policy file's rules unless
+// its policy has been updated.
+func (a *Authorizer) BootstrapPolicy(policy string) error {
+	if a.store == nil {
+		return errors.New("ACL policy isn't replicated")
+	}
+	enforcer, err := casbin.NewEnforcerSafe(a.model, policy)
+	if err == nil {
+		err = validate(enforcer)
+	}
+	if err != nil {
+		return err
+	}
+	return a.store.BootstrapPolicy(enforcerRules(enforcer))
+}
+
+// Reload rereads the model and policy and, if they load with complete rules
+// and the policy isn't empty, swaps them in for the current ones. It returns
+// the rules the new policy added and removed.
+func (a *Authorizer) Reload() (added, removed []string, err error) {
+	if a.store != nil {
+		return nil, nil, errors.New("ACL policy is replicated; change it with UpdatePolicy")
+	}
+	a.reloads.Lock()
+	defer a.reloads.Unlock()
+	b, err := os.ReadFile(a.policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.reload(b)
+}
+
+func (a *Authorizer) reload(policy []byte) (added, removed []string, err error) {
+	// loaded from the bytes read rather than the file, which may have
+	// changed since, so loaded is what's enforced
+	enforcer, err := casbin.NewEnforcerSafe(a.model, &bytesAdapter{policy: policy})
+	if err == nil {
+		err = validate(enforcer)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(enforcerRules(enforcer)) == 0 {
+		// more likely a file caught mid-write than a policy denying everyone
+		return nil, nil, errors.New("refusing to load an empty ACL policy")
+	}
+	added, removed = a.swap(enforcer)
+	a.loaded = policy
+	return added, removed, nil
+}
+
+// watchStore reloads the policy after the PolicyStore changes it. It's
+// reloaded here rather than as the store is notified, which it may be as
+// its changes are applied, so applying them doesn't wait on a reload.
+func (a *Authorizer) watchStore() {
+	for {
+		select {
+		case <-a.changes:
+			a.reloadStore()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *Authorizer) reloadStore() {
+	enforcer, err := casbin.NewEnforcerSafe(a.model, &storeAdapter{store: a.store})
+	if err != nil {
+		a.logger.Error("failed to reload replicated ACL policy", zap.Error(err))
+		return
+	}
+	a.swap(enforcer)
+}
+
+// swap enforces the enforcer's policy in place of the current one, logging
+// and returning the rules it added and removed.
+func (a *Authorizer) swap(enforcer *casbin.Enforcer) (added, removed []string) {
+	rules := ruleSet(enforcer)
+	old := map[string]bool{}
+	if current := a.enforcer.Load(); current != nil {
+		old = ruleSet(current)
+	}
+	a.enforcer.Store(enforcer)
+
+	for rule := range rules {
+		if !old[rule] {
+			added = append(added, rule)
+		}
+	}
+	for rule := range old {
+		if !rules[rule] {
+			removed = append(removed, rule)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	a.logger.Info(
+		"reloaded ACL policy",
+		zap.String("policy", a.policy),
+		zap.Strings("added", added),
+		zap.Strings("removed", removed),
+	)
+	return added, removed
+}
+
+// validate checks each policy rule has a value for each of the model's
+// fields, which casbin doesn't.
+func validate(e *casbin.Enforcer) error {
+	model := e.GetModel()
+	for _, rule := range enforcerRules(e) {
+		if err := checkRule(model, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforcerRules returns the enforcer's p and g rules, each its type followed
+// by its values.
+func enforcerRules(e *casbin.Enforcer) [][]string {
+	var rules [][]string
+	model := e.GetModel()
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				rules = append(rules, append([]string{ptype}, rule...))
+			}
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return ruleString(rules[i]) < ruleString(rules[j])
+	})
+	return rules
+}
+
+func ruleSet(e *casbin.Enforcer) map[string]bool {
+	rules := make(map[string]bool)
+	for _, rule := range enforcerRules(e) {
+		rules[ruleString(rule)] = true
+	}
+	return rules
+}
+
+// ruleString formats the rule as a line of a policy file.
+func ruleString(rule []string) string {
+	return strings.Join(rule, ", ")
+}
+
+// watchDelay is how long the policy file must go unchanged before it's
+// reloaded, so an editor's several writes cause one reload.
+const watchDelay = 100 * time.Millisecond
+
+// Watch reloads the policy whenever its file's contents change, until Close
+// is called. It watches the file's directory so it sees the file replaced,
+// or a symlink to it swapped, as well as written.
+func (a *Authorizer) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(a.policy)); err != nil {
+		watcher.Close()
+		return err
+	}
+	a.watcher = watcher
+	go a.watch()
+	return nil
+}
+
+func (a *Authorizer) watch() {
+	var changed <-chan time.Time
+	for {
+		select {
+		case _, ok := <-a.watcher.Events:
+			if !ok {
+				return
+			}
+			changed = time.After(watchDelay)
+		case err, ok := <-a.watcher.Errors:
+			if !ok {
+				return
+			}
+			a.logger.Error("failed to watch ACL policy", zap.Error(err))
+		case <-changed:
+			changed = nil
+			a.reloadChanged()
+		}
+	}
+}
+
+func (a *Authorizer) reloadChanged() {
+	a.reloads.Lock()
+	defer a.reloads.Unlock()
+	b, err := os.ReadFile(a.policy)
+	if err == nil && bytes.Equal(b, a.loaded) {
+		return
+	}
+	if err == nil {
+		_, _, err = a.reload(b)
+	}
+	if err != nil {
+		a.logger.Error(
+			"failed to reload ACL policy",
+			zap.String("policy", a.policy),
+			zap.Error(err),
+		)
+	}
+}
+
+// Close stops watching the policy file, or reloading the replicated policy.
+func (a *Authorizer) Close() error {
+	if a.done != nil {
+		close(a.done)
+	}
+	if a.watcher == nil {
+		return nil
+	}
+	return a.watcher.Close()
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/config"
+)
+
+func TestReload(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	writePolicy(t, policy, "p, root, log, produce\n")
+
+	a := New(config.ACLModelFile, policy)
+	require.NoError(t, a.Authorize("root", "log", "produce"))
+	require.Error(t, a.Authorize("nobody", "log", "consume"))
+
+	writePolicy(t, policy, "p, nobody, log, consume\n")
+	added, removed, err := a.Reload()
+	require.NoError(t, err)
+	require.Equal(t, []string{"p, nobody, log, consume"}, added)
+	require.Equal(t, []string{"p, root, log, produce"}, removed)
+	require.Error(t, a.Authorize("root", "log", "produce"))
+	require.NoError(t, a.Authorize("nobody", "log", "consume"))
+
+	// a policy that doesn't load leaves the current one in place
+	for _, bad := range []string{"", "p, root\n"} {
+		writePolicy(t, policy, bad)
+		_, _, err = a.Reload()
+		require.Error(t, err)
+		require.NoError(t, a.Authorize("nobody", "log", "consume"))
+	}
+
+	// the policy enforced is the one read, whatever the file holds since
+	writePolicy(t, policy, "p, root, log, produce\n")
+	_, _, err = a.reload([]byte("p, nobody, log, produce\n"))
+	require.NoError(t, err)
+	require.NoError(t, a.Authorize("nobody", "log", "produce"))
+	require.Error(t, a.Authorize("root", "log", "produce"))
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.csv")
+	writePolicy(t, policy, "p, root, log, produce\n")
+
+	a := New(config.ACLModelFile, policy)
+	require.NoError(t, a.Watch())
+	defer a.Close()
+
+	writePolicy(t, policy, "p, root, log, produce\np, nobody, log, consume\n")
+	require.Eventually(t, func() bool {
+		return a.Authorize("nobody", "log", "consume") == nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// replacing the file, as editors and config management do
+	replacement := filepath.Join(dir, "policy.csv.new")
+	writePolicy(t, replacement, "p, root, log, produce\n")
+	require.NoError(t, os.Rename(replacement, policy))
+	require.Eventually(t, func() bool {
+		return a.Authorize("nobody", "log", "consume") != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, a.Authorize("root", "log", "produce"))
+}
+
+func writePolicy(t *testing.T, file, policy string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(file, []byte(policy), 0600))
+}
+
+func TestReplicated(t *testing.T) {
+	store := &memoryStore{}
+	a, err := NewReplicated(config.ACLModelFile, store)
+	require.NoError(t, err)
+	defer a.Close()
+	require.Error(t, a.Authorize("root", "log", "produce"))
+
+	// the policy is reloaded in the background after each change
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	writePolicy(t, policy, "p, admin, log, produce\ng, root, admin\n")
+	require.NoError(t, a.BootstrapPolicy(policy))
+	require.Eventually(t, func() bool {
+		return a.Authorize("root", "log", "produce") == nil
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, a.UpdatePolicy(
+		[][]string{{"g", "nobody", "admin"}},
+		[][]string{{"g", "root", "admin"}},
+	))
+	require.Eventually(t, func() bool {
+		return a.Authorize("nobody", "log", "produce") == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Error(t, a.Authorize("root", "log", "produce"))
+	require.Equal(t, [][]string{
+		{"g", "nobody", "admin"},
+		{"p", "admin", "log", "produce"},
+	}, a.Policy())
+
+	// bootstrapping again doesn't undo the update
+	require.NoError(t, a.BootstrapPolicy(policy))
+	require.Error(t, a.Authorize("root", "log", "produce"))
+
+	for _, bad := range [][]string{
+		{"p", "root", "log"},
+		{"g", "root"},
+		{"x", "root", "log", "produce"},
+		{},
+	} {
+		require.Error(t, a.UpdatePolicy([][]string{bad}, nil))
+	}
+	_, _, err = a.Reload()
+	require.Error(t, err)
+}
+
+// memoryStore is a PolicyStore that notifies as a replicated store does once
+// a change has been applied.
+type memoryStore struct {
+	mu      sync.Mutex
+	rules   [][]string
+	updated bool
+	notify  []chan<- struct{}
+}
+
+func (s *memoryStore) Policy() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rules
+}
+
+func (s *memoryStore) UpdatePolicy(add, remove [][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(add, remove)
+	return nil
+}
+
+func (s *memoryStore) update(add, remove [][]string) {
+	var rules [][]string
+	for _, rule := range s.rules {
+		if !containsRule(remove, rule) {
+			rules = append(rules, rule)
+		}
+	}
+	for _, rule := range add {
+		if !containsRule(rules, rule) {
+			rules = append(rules, rule)
+		}
+	}
+	s.rules, s.updated = rules, true
+	for _, ch := range s.notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *memoryStore) BootstrapPolicy(rules [][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.updated {
+		s.update(rules, nil)
+	}
+	return nil
+}
+
+func (s *memoryStore) NotifyPolicy(ch chan<- struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notify = append(s.notify, ch)
+}
+
+func containsRule(rules [][]string, rule []string) bool {
+	for _, r := range rules {
+		if ruleString(r) == ruleString(rule) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package authn
+
+import (
+	"crypto/tls"
+	"strings"
+)
+
+// Credentials are what a client presented to identify itself.
+type Credentials struct {
+	// TLS is the connection's state if it's over TLS.
+	TLS *tls.ConnectionState
+	// Token is the request's bearer token, if it has one.
+	Token string
+}
+
+// Authenticator resolves credentials to a subject. It returns false if the
+// credentials don't carry the kind of identity it handles, and an error if
+// they do but it's invalid.
+type Authenticator interface {
+	Authenticate(Credentials) (subject string, ok bool, err error)
+}
+
+// Chain tries each of its authenticators in turn, taking the first subject
+// one resolves. An invalid identity fails the chain rather than falling
+// through to the next authenticator.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(creds Credentials) (string, bool, error) {
+	for _, a := range c {
+		subject, ok, err := a.Authenticate(creds)
+		if err != nil || ok {
+			return subject, ok, err
+		}
+	}
+	return "", false, nil
+}
+
+// BearerToken returns the token of an "Authorization: Bearer <token>" header
+// value, or "" if it isn't one.
+func BearerToken(header string) string {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,136 @@
+package authn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificate(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "root"},
+		DNSNames: []string{"root.example.org"},
+	}
+	subject, ok, err := Certificate{}.Authenticate(tlsCredentials(cert))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "root", subject)
+
+	subject, _, _ = Certificate{SAN: true}.Authenticate(tlsCredentials(cert))
+	require.Equal(t, "root.example.org", subject)
+
+	// unverified or plaintext connections aren't identified
+	_, ok, err = Certificate{}.Authenticate(Credentials{TLS: &tls.ConnectionState{}})
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, _ = Certificate{}.Authenticate(Credentials{})
+	require.False(t, ok)
+}
+
+func TestSPIFFE(t *testing.T) {
+	id, _ := url.Parse("spiffe://example.org/ns/prod/sa/producer")
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "root"}, URIs: []*url.URL{id}}
+	a := SPIFFE{TrustDomain: "example.org"}
+	subject, ok, err := a.Authenticate(tlsCredentials(cert))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, id.String(), subject)
+
+	_, _, err = SPIFFE{TrustDomain: "other.org"}.Authenticate(tlsCredentials(cert))
+	require.Error(t, err)
+
+	_, ok, err = a.Authenticate(tlsCredentials(&x509.Certificate{}))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// SPIFFE IDs fall back to common names in a chain
+	c := Chain{a, Certificate{}}
+	subject, _, _ = c.Authenticate(tlsCredentials(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "root"},
+	}))
+	require.Equal(t, "root", subject)
+}
+
+func TestJWT(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writeJWKS(t, file, "1", pub)
+
+	a, err := NewJWT(JWTConfig{JWKSFile: file, Issuer: "issuer", Audience: "log"})
+	require.NoError(t, err)
+	claims := jwt.MapClaims{
+		"sub": "producer",
+		"iss": "issuer",
+		"aud": "log",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	subject, ok, err := a.Authenticate(Credentials{Token: sign(t, "1", key, claims)})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "producer", subject)
+
+	_, ok, err = a.Authenticate(Credentials{})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	for name, c := range map[string]jwt.MapClaims{
+		"expired":      {"sub": "producer", "iss": "issuer", "aud": "log", "exp": time.Now().Add(-time.Hour).Unix()},
+		"no expiry":    {"sub": "producer", "iss": "issuer", "aud": "log"},
+		"wrong issuer": {"sub": "producer", "iss": "other", "aud": "log", "exp": exp},
+		"no audience":  {"sub": "producer", "iss": "issuer", "exp": exp},
+		"no subject":   {"iss": "issuer", "aud": "log", "exp": exp},
+	} {
+		_, _, err = a.Authenticate(Credentials{Token: sign(t, "1", key, c)})
+		require.Error(t, err, name)
+	}
+	_, _, err = a.Authenticate(Credentials{Token: sign(t, "2", key, claims)})
+	require.Error(t, err)
+
+	// rotated keys are picked up once the file's checked again
+	pub, key, err = ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writeJWKS(t, file, "2", pub)
+	require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)))
+	a.checked = time.Time{}
+	subject, _, err = a.Authenticate(Credentials{Token: sign(t, "2", key, claims)})
+	require.NoError(t, err)
+	require.Equal(t, "producer", subject)
+}
+
+func tlsCredentials(cert *x509.Certificate) Credentials {
+	return Credentials{TLS: &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{cert}},
+	}}
+}
+
+func writeJWKS(t *testing.T, file, kid string, pub ed25519.PublicKey) {
+	t.Helper()
+	jwks := fmt.Sprintf(
+		`{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": %q, "x": %q}]}`,
+		kid, base64.RawURLEncoding.EncodeToString(pub),
+	)
+	require.NoError(t, os.WriteFile(file, []byte(jwks), 0600))
+}
+
+func sign(t *testing.T, kid string, key ed25519.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
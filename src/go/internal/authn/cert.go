@@ -0,0 +1,80 @@
+package authn
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Certificate identifies clients by their verified certificate's common
+// name or, with SAN set, by its first DNS or email subject alternative name,
+// falling back to the common name.
+type Certificate struct {
+	SAN bool
+}
+
+func (a Certificate) Authenticate(creds Credentials) (string, bool, error) {
+	cert := leaf(creds)
+	if cert == nil {
+		return "", false, nil
+	}
+	if a.SAN {
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0], true, nil
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0], true, nil
+		}
+	}
+	if cert.Subject.CommonName == "" {
+		return "", false, nil
+	}
+	return cert.Subject.CommonName, true, nil
+}
+
+// SPIFFE identifies clients by the SPIFFE ID in their verified certificate's
+// URI SANs, such as spiffe://example.org/ns/prod/sa/producer, which is the
+// subject as a whole. IDs outside TrustDomain are rejected if it's set.
+type SPIFFE struct {
+	TrustDomain string
+}
+
+func (a SPIFFE) Authenticate(creds Credentials) (string, bool, error) {
+	cert := leaf(creds)
+	if cert == nil {
+		return "", false, nil
+	}
+	var id *url.URL
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		// an SVID has exactly one SPIFFE ID
+		if id != nil {
+			return "", false, fmt.Errorf("certificate has more than one SPIFFE ID")
+		}
+		id = uri
+	}
+	if id == nil {
+		return "", false, nil
+	}
+	if id.Host == "" || id.User != nil || id.Port() != "" ||
+		id.RawQuery != "" || id.Fragment != "" {
+		return "", false, fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+	if a.TrustDomain != "" && !strings.EqualFold(id.Host, a.TrustDomain) {
+		return "", false, fmt.Errorf(
+			"SPIFFE ID %q isn't in trust domain %s", id, a.TrustDomain,
+		)
+	}
+	return id.String(), true, nil
+}
+
+func leaf(creds Credentials) *x509.Certificate {
+	if creds.TLS == nil || len(creds.TLS.VerifiedChains) == 0 ||
+		len(creds.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return creds.TLS.VerifiedChains[0][0]
+}
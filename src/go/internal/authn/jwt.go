@@ -0,0 +1,251 @@
+package authn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksCheckInterval is how often JWT checks its JWKS file for changes.
+const jwksCheckInterval = time.Second
+
+type JWTConfig struct {
+	// JWKSFile is a JSON Web Key Set holding the keys tokens are signed
+	// with. It's reloaded when it changes.
+	JWKSFile string
+	// Issuer and Audience, if set, must match the tokens' iss and aud.
+	Issuer   string
+	Audience string
+	// SubjectClaim is the claim holding the subject, "sub" by default.
+	SubjectClaim string
+}
+
+// JWT identifies clients by the subject of their bearer token, a JWT signed
+// by one of the JWKS's keys.
+type JWT struct {
+	JWTConfig
+	parser *jwt.Parser
+
+	mu      sync.Mutex
+	keys    map[string]jwk
+	modTime time.Time
+	checked time.Time
+}
+
+type jwk struct {
+	alg string
+	key interface{}
+}
+
+func NewJWT(config JWTConfig) (*JWT, error) {
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = "sub"
+	}
+	a := &JWT{
+		JWTConfig: config,
+		parser: jwt.NewParser(jwt.WithValidMethods([]string{
+			"RS256", "RS384", "RS512", "PS256", "PS384", "PS512",
+			"ES256", "ES384", "ES512", "EdDSA",
+		})),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *JWT) Authenticate(creds Credentials) (string, bool, error) {
+	if creds.Token == "" {
+		return "", false, nil
+	}
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(creds.Token, claims, a.key)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid token: %w", err)
+	}
+	// MapClaims only checks exp when it's there
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", false, fmt.Errorf("invalid token: no exp claim")
+	}
+	if a.Issuer != "" && !claims.VerifyIssuer(a.Issuer, true) {
+		return "", false, fmt.Errorf("invalid token: issuer isn't %s", a.Issuer)
+	}
+	if a.Audience != "" && !claims.VerifyAudience(a.Audience, true) {
+		return "", false, fmt.Errorf("invalid token: audience isn't %s", a.Audience)
+	}
+	subject, _ := claims[a.SubjectClaim].(string)
+	if subject == "" {
+		return "", false, fmt.Errorf("invalid token: no %s claim", a.SubjectClaim)
+	}
+	return subject, true, nil
+}
+
+func (a *JWT) key(token *jwt.Token) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.checked) >= jwksCheckInterval {
+		// a broken update keeps the keys we have
+		_ = a.reload()
+	}
+	kid, _ := token.Header["kid"].(string)
+	k, ok := a.keys[kid]
+	if !ok && kid == "" && len(a.keys) == 1 {
+		for _, k = range a.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if k.alg != "" && k.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("key %q isn't for %s", kid, token.Method.Alg())
+	}
+	return k.key, nil
+}
+
+func (a *JWT) load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reload()
+}
+
+// reload reads the JWKS file if it's changed since it was last read.
+func (a *JWT) reload() error {
+	a.checked = time.Now()
+	fi, err := os.Stat(a.JWKSFile)
+	if err != nil {
+		return err
+	}
+	if a.keys != nil && fi.ModTime().Equal(a.modTime) {
+		return nil
+	}
+	b, err := os.ReadFile(a.JWKSFile)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.JWKSFile, err)
+	}
+	a.keys, a.modTime = keys, fi.ModTime()
+	return nil
+}
+
+func parseJWKS(b []byte) (map[string]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k.N, k.E)
+		case "EC":
+			key, err = ecKey(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = okpKey(k.Crv, k.X)
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, fmt.Errorf("duplicate key %q", k.Kid)
+		}
+		keys[k.Kid] = jwk{alg: k.Alg, key: key}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys")
+	}
+	return keys, nil
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func ecKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xb),
+		Y:     new(big.Int).SetBytes(yb),
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point isn't on %s", crv)
+	}
+	return key, nil
+}
+
+func okpKey(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(xb) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 key")
+	}
+	return ed25519.PublicKey(xb), nil
+}
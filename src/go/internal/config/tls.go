@@ -1,56 +1,429 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
 )
 
+var (
+	tlsFile = tag.MustNewKey("file")
+
+	certificateExpiry = stats.Int64(
+		"tls/certificate_expiry",
+		"Unix time the earliest certificate in a file expires",
+		stats.UnitSeconds,
+	)
+
+	// TLSViews are the views of the expiry of the certificates and CAs TLS
+	// configs load, tagged with their file.
+	TLSViews = []*view.View{
+		{
+			Measure:     certificateExpiry,
+			TagKeys:     []tag.Key{tlsFile},
+			Aggregation: view.LastValue(),
+		},
+	}
+)
+
+// certReloadInterval is how often TLS configs check their files for changes.
+var certReloadInterval = time.Second
+
 type TLSConfig struct {
 	CertFile      string
 	KeyFile       string
 	CAFile        string
 	ServerAddress string
 	Server        bool
+	// CRLFile holds PEM encoded CRLs, signed by CAs in the CAFile, of the
+	// certificates peers can no longer use. It's reread when it changes.
+	CRLFile string
 }
 
+// SetupTLSConfig returns a TLS config that rereads its certificate, key, CA
+// and CRL from disk when they change, so they can be rotated without
+// restarting. A broken update is logged and the files last loaded are used
+// until it's fixed.
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
-	var err error
+	if cfg.CRLFile != "" && cfg.CAFile == "" {
+		return nil, fmt.Errorf("a CRL needs a CA file to verify it with")
+	}
+	files := &tlsFiles{
+		TLSConfig: cfg,
+		logger:    zap.L().Named("tls"),
+	}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+
 	tlsConfig := &tls.Config{}
 	if cfg.CertFile != "" && cfg.KeyFile != "" {
-		tlsConfig.Certificates = make([]tls.Certificate, 1)
-		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(
-			cfg.CertFile,
-			cfg.KeyFile,
-		)
-		if err != nil {
-			return nil, err
+		if cfg.Server {
+			tlsConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert, _ := files.current()
+				return cert, nil
+			}
+		} else {
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				cert, _ := files.current()
+				return cert, nil
+			}
 		}
 	}
 
 	if cfg.CAFile != "" {
-		b, err := ioutil.ReadFile(cfg.CAFile)
+		tlsConfig.ServerName = cfg.ServerAddress
+		if cfg.Server {
+			// the client's chain is verified by crypto/tls, so the
+			// connection state has it, against the CA current when the
+			// handshake starts
+			_, tlsConfig.ClientCAs = files.current()
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if cfg.CRLFile != "" {
+				tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+					return files.checkRevoked(cs.VerifiedChains)
+				}
+			}
+			tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				c := tlsConfig.Clone()
+				c.GetConfigForClient = nil
+				_, c.ClientCAs = files.current()
+				return c, nil
+			}
+		} else {
+			// crypto/tls only verifies servers against a fixed RootCAs, so
+			// it's skipped for verifyServer's
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = files.verifyServer
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// WithNextProtos returns a copy of the TLS config negotiating the protocols.
+// A copy's changes are otherwise lost on the configs the original's
+// GetConfigForClient returns, which are copies of the original.
+func WithNextProtos(tlsConfig *tls.Config, protos ...string) *tls.Config {
+	c := tlsConfig.Clone()
+	c.NextProtos = protos
+	if get := c.GetConfigForClient; get != nil {
+		c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := get(hello)
+			if cfg != nil {
+				cfg = cfg.Clone()
+				cfg.NextProtos = protos
+			}
+			return cfg, err
+		}
+	}
+	return c
+}
+
+// tlsFiles holds the certificate and CA last loaded from a TLSConfig's files.
+type tlsFiles struct {
+	TLSConfig
+	logger *zap.Logger
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	ca   *x509.CertPool
+	// revoked holds the serials revoked by each CA, by the CA's raw subject.
+	revoked  map[string]map[string]bool
+	modTimes []time.Time
+	checked  time.Time
+}
+
+// current returns the certificate and CA, reloading them if their files
+// have changed.
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.check()
+	return f.cert, f.ca
+}
+
+func (f *tlsFiles) revocations() map[string]map[string]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.check()
+	return f.revoked
+}
+
+// check reloads the files if they've changed, checking at most every
+// certReloadInterval.
+func (f *tlsFiles) check() {
+	if time.Since(f.checked) >= certReloadInterval {
+		f.checked = time.Now()
+		modTimes, err := f.stat()
+		if err == nil && !equalTimes(modTimes, f.modTimes) {
+			err = f.reload(modTimes)
+			if err == nil {
+				f.logger.Info("reloaded certificates",
+					zap.String("cert", f.CertFile),
+					zap.String("ca", f.CAFile),
+					zap.String("crl", f.CRLFile),
+				)
+			}
+		}
+		if err != nil {
+			f.logger.Error("failed to reload certificates", zap.Error(err))
+		}
+	}
+}
+
+func (f *tlsFiles) load() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	modTimes, err := f.stat()
+	if err != nil {
+		return err
+	}
+	f.checked = time.Now()
+	return f.reload(modTimes)
+}
+
+func (f *tlsFiles) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range []string{f.CertFile, f.KeyFile, f.CAFile, f.CRLFile} {
+		if file == "" {
+			modTimes = append(modTimes, time.Time{})
+			continue
+		}
+		fi, err := os.Stat(file)
 		if err != nil {
 			return nil, err
 		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	return modTimes, nil
+}
+
+// reload reads the files, keeping what was loaded before if any are invalid,
+// such as a certificate that's been rotated before its key.
+func (f *tlsFiles) reload(modTimes []time.Time) error {
+	var cert *tls.Certificate
+	if f.CertFile != "" && f.KeyFile != "" {
+		pair, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return err
+		}
+		pair.Leaf = leaf
+		cert = &pair
+		recordExpiry(f.CertFile, leaf.NotAfter)
+	}
+	var ca *x509.CertPool
+	var certs []*x509.Certificate
+	if f.CAFile != "" {
+		var err error
+		certs, err = readCertificates(f.CAFile)
+		if err != nil {
+			return err
+		}
+		ca = x509.NewCertPool()
+		expiry := certs[0].NotAfter
+		for _, c := range certs {
+			ca.AddCert(c)
+			if c.NotAfter.Before(expiry) {
+				expiry = c.NotAfter
+			}
+		}
+		recordExpiry(f.CAFile, expiry)
+	}
+	var revoked map[string]map[string]bool
+	if f.CRLFile != "" {
+		var err error
+		revoked, err = f.readCRLs(certs)
+		if err != nil {
+			return err
+		}
+	}
+	f.cert, f.ca, f.revoked, f.modTimes = cert, ca, revoked, modTimes
+	return nil
+}
 
-		ca := x509.NewCertPool()
-		ok := ca.AppendCertsFromPEM([]byte(b))
-		if !ok {
+// readCRLs reads the CRL file's revoked serials, checking each CRL was signed
+// by one of the CAs.
+func (f *tlsFiles) readCRLs(cas []*x509.Certificate) (map[string]map[string]bool, error) {
+	b, err := os.ReadFile(f.CRLFile)
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[string]map[string]bool)
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.CRLFile, err)
+		}
+		var issuer *x509.Certificate
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				issuer = ca
+				break
+			}
+		}
+		if issuer == nil {
 			return nil, fmt.Errorf(
-				"failed to parse root certificate: %q",
-				cfg.CAFile,
+				"%s: CRL from %s isn't signed by a CA in %s",
+				f.CRLFile, crl.Issuer, f.CAFile,
 			)
 		}
-		if cfg.Server {
-			tlsConfig.ClientCAs = ca
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		} else {
-			tlsConfig.RootCAs = ca
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			f.logger.Warn("CRL is past its next update",
+				zap.String("crl", f.CRLFile),
+				zap.String("issuer", crl.Issuer.String()),
+				zap.Time("next_update", crl.NextUpdate),
+			)
+		}
+		serials := revoked[string(issuer.RawSubject)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(issuer.RawSubject)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
 		}
-		tlsConfig.ServerName = cfg.ServerAddress
 	}
+	if len(revoked) == 0 {
+		return nil, fmt.Errorf("failed to parse CRL: %q", f.CRLFile)
+	}
+	return revoked, nil
+}
 
-	return tlsConfig, nil
+// checkRevoked rejects the peer if any certificate in its chains was revoked
+// by its issuer.
+func (f *tlsFiles) checkRevoked(chains [][]*x509.Certificate) error {
+	revoked := f.revocations()
+	if revoked == nil {
+		return nil
+	}
+	for _, chain := range chains {
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			if !revoked[string(issuer.RawSubject)][cert.SerialNumber.String()] {
+				continue
+			}
+			f.logger.Warn("rejected revoked certificate",
+				zap.String("subject", cert.Subject.String()),
+				zap.String("serial", cert.SerialNumber.String()),
+				zap.String("issuer", issuer.Subject.String()),
+				zap.String("crl", f.CRLFile),
+			)
+			return fmt.Errorf(
+				"certificate %s with serial %s is revoked",
+				cert.Subject, cert.SerialNumber,
+			)
+		}
+	}
+	return nil
+}
+
+// verifyServer verifies the server's chain against the current CA, as
+// crypto/tls would against RootCAs, and its name. The name is the one sent
+// with SNI or else the ServerAddress; crypto/tls doesn't send IP addresses,
+// so a server dialed by one needs a ServerAddress, and without either name
+// the connection's refused rather than trusting any certificate the CA's
+// issued.
+func (f *tlsFiles) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("server sent no certificate")
+	}
+	name := cs.ServerName
+	if name == "" {
+		name = f.ServerAddress
+	}
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	if name == "" {
+		return fmt.Errorf("no server name to verify the server's certificate with: set the ServerAddress")
+	}
+	_, ca := f.current()
+	opts := x509.VerifyOptions{
+		Roots:         ca,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := cs.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return err
+	}
+	return f.checkRevoked(chains)
+}
+
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf(
+			"failed to parse root certificate: %q",
+			file,
+		)
+	}
+	return certs, nil
+}
+
+func recordExpiry(file string, expiry time.Time) {
+	_ = stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(tlsFile, file)},
+		certificateExpiry.M(expiry.Unix()),
+	)
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfigRotates(t *testing.T) {
+	certReloadInterval = 0
+	defer func() { certReloadInterval = time.Second }()
+
+	dir := t.TempDir()
+	server := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	}
+	client := TLSConfig{
+		CertFile:      filepath.Join(dir, "client.pem"),
+		KeyFile:       filepath.Join(dir, "client-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		ServerAddress: "127.0.0.1",
+	}
+	ca := newCA(t)
+	ca.write(t, server.CAFile)
+	ca.issue(t, "server", server.CertFile, server.KeyFile)
+	ca.issue(t, "client", client.CertFile, client.KeyFile)
+
+	serverConfig, err := SetupTLSConfig(server)
+	require.NoError(t, err)
+	clientConfig, err := SetupTLSConfig(client)
+	require.NoError(t, err)
+	state, err := handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, "client", state.VerifiedChains[0][0].Subject.CommonName)
+
+	// a new CA and certificates are picked up without a new config
+	rotated := newCA(t)
+	rotated.issue(t, "server", server.CertFile, server.KeyFile)
+	rotated.issue(t, "rotated", client.CertFile, client.KeyFile)
+	// but not until the CA's rotated too
+	_, err = handshake(serverConfig, clientConfig)
+	require.Error(t, err)
+	rotated.write(t, server.CAFile)
+	state, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, "rotated", state.VerifiedChains[0][0].Subject.CommonName)
+
+	// a broken key keeps the last certificate
+	writePEM(t, client.KeyFile, "EC PRIVATE KEY", []byte("broken"))
+	state, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, "rotated", state.VerifiedChains[0][0].Subject.CommonName)
+}
+
+func TestSetupTLSConfigNeedsServerName(t *testing.T) {
+	dir := t.TempDir()
+	server := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	}
+	client := TLSConfig{
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	ca := newCA(t)
+	ca.write(t, server.CAFile)
+	ca.issue(t, "server", server.CertFile, server.KeyFile)
+	ca.issue(t, "client", client.CertFile, client.KeyFile)
+
+	serverConfig, err := SetupTLSConfig(server)
+	require.NoError(t, err)
+	// dialed by IP, there's no SNI to verify the server's name with
+	clientConfig, err := SetupTLSConfig(client)
+	require.NoError(t, err)
+	_, err = handshake(serverConfig, clientConfig)
+	require.Error(t, err)
+
+	client.ServerAddress = "127.0.0.1:8400"
+	clientConfig, err = SetupTLSConfig(client)
+	require.NoError(t, err)
+	_, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+}
+
+func TestSetupTLSConfigCRL(t *testing.T) {
+	certReloadInterval = 0
+	defer func() { certReloadInterval = time.Second }()
+
+	dir := t.TempDir()
+	server := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CRLFile:  filepath.Join(dir, "crl.pem"),
+		Server:   true,
+	}
+	client := TLSConfig{
+		CertFile:      filepath.Join(dir, "client.pem"),
+		KeyFile:       filepath.Join(dir, "client-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		CRLFile:       filepath.Join(dir, "crl.pem"),
+		ServerAddress: "127.0.0.1",
+	}
+	ca := newCA(t)
+	ca.write(t, server.CAFile)
+	serverCert := ca.issue(t, "server", server.CertFile, server.KeyFile)
+	revoked := ca.issue(t, "revoked", client.CertFile, client.KeyFile)
+	ca.revoke(t, server.CRLFile)
+
+	serverConfig, err := SetupTLSConfig(server)
+	require.NoError(t, err)
+	clientConfig, err := SetupTLSConfig(client)
+	require.NoError(t, err)
+	_, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+
+	// servers reject revoked clients
+	ca.revoke(t, server.CRLFile, revoked)
+	_, err = handshake(serverConfig, clientConfig)
+	require.Error(t, err)
+	ca.issue(t, "client", client.CertFile, client.KeyFile)
+	state, err := handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, "client", state.VerifiedChains[0][0].Subject.CommonName)
+
+	// and clients revoked servers
+	ca.revoke(t, server.CRLFile, revoked, serverCert)
+	_, err = handshake(serverConfig, clientConfig)
+	require.Error(t, err)
+
+	// CRLs must be signed by the CA
+	newCA(t).revoke(t, server.CRLFile)
+	_, err = SetupTLSConfig(server)
+	require.Error(t, err)
+}
+
+func handshake(serverConfig, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer ln.Close()
+	errc := make(chan error, 1)
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer c.Close()
+		client := tls.Client(c, clientConfig)
+		err = client.Handshake()
+		if err == nil {
+			// TLS 1.3 servers verify clients after the client's handshake
+			// is done, so read any alert rejecting it
+			_, err = client.Read(make([]byte, 1))
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		errc <- err
+	}()
+	s, err := ln.Accept()
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	server := tls.Server(s, WithNextProtos(serverConfig, "h2"))
+	serverErr := server.Handshake()
+	state := server.ConnectionState()
+	s.Close()
+	if err := <-errc; err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return state, serverErr
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) write(t *testing.T, file string) {
+	t.Helper()
+	writePEM(t, file, "CERTIFICATE", ca.cert.Raw)
+}
+
+func (ca *testCA) issue(t *testing.T, name, certFile, keyFile string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func (ca *testCA) revoke(t *testing.T, file string, certs ...*x509.Certificate) {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, cert := range certs {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+	writePEM(t, file, "X509 CRL", der)
+}
+
+var modTime = time.Now()
+
+// writePEM writes the file, moving its modification time on so it's seen to
+// have changed however soon it was last written.
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, os.WriteFile(file, b, 0600))
+	modTime = modTime.Add(time.Second)
+	require.NoError(t, os.Chtimes(file, modTime, modTime))
+}
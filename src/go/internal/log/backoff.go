@@ -0,0 +1,34 @@
+package log
+
+import "time"
+
+// backoff doubles the wait between retries from min up to max.
+type backoff struct {
+	min  time.Duration
+	max  time.Duration
+	next time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, next: min}
+}
+
+func (b *backoff) reset() {
+	b.next = b.min
+}
+
+// wait sleeps for the current backoff and doubles it, returning false if stop
+// is closed first.
+func (b *backoff) wait(stop <-chan struct{}) bool {
+	t := time.NewTimer(b.next)
+	defer t.Stop()
+	if b.next *= 2; b.next > b.max {
+		b.next = b.max
+	}
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"time"
+
 	"github.com/hashicorp/raft"
 )
 
@@ -9,10 +11,19 @@ type Config struct {
 		raft.Config
 		StreamLayer raft.StreamLayer
 		Bootstrap   bool
+		// SnapshotRetain is the number of snapshots kept on disk.
+		SnapshotRetain int
+		// TransportMaxPool is the number of idle connections kept per peer.
+		TransportMaxPool int
+		// TransportTimeout bounds Raft's network I/O with peers.
+		TransportTimeout time.Duration
 	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	// TxnTimeout is how long a transaction can stay open before the leader
+	// aborts it. A minute by default.
+	TxnTimeout time.Duration
 }
@@ -2,33 +2,50 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/raft"
-	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/schema"
 )
 
 type DistributedLog struct {
-	config Config
-	log    *Log
-	raft   *raft.Raft
+	config    Config
+	log       *Log
+	producers *producers
+	txns      *txns
+	schemas   *schema.Registry
+	policy    *policy
+	raft      *raft.Raft
+	logger    *zap.Logger
+	closed    chan struct{}
 }
 
+// defaultTxnTimeout is how long transactions stay open when the Config
+// doesn't set a TxnTimeout.
+const defaultTxnTimeout = time.Minute
+
 func NewDistributedLog(dataDir string, config Config) (
 	*DistributedLog,
 	error,
 ) {
 	l := &DistributedLog{
 		config: config,
+		logger: zap.L().Named("distributed-log"),
+		closed: make(chan struct{}),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -36,6 +53,7 @@ func NewDistributedLog(dataDir string, config Config) (
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	go l.expireTxns()
 	return l, nil
 }
 
@@ -50,7 +68,11 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
-	fsm := &fsm{log: l.log}
+	fsm := newFSM(l.log)
+	l.producers = fsm.producers
+	l.txns = fsm.txns
+	l.schemas = fsm.schemas
+	l.policy = fsm.policy
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
@@ -63,14 +85,22 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 		return err
 	}
 
-	stableStore, err := raftboltdb.NewBoltStore(
-		filepath.Join(dataDir, "raft", "stable"),
+	stableStore, err := newStableStore(
+		filepath.Join(dataDir, "raft", "stable.dat"),
 	)
 	if err != nil {
 		return err
 	}
+	// the stable store was a BoltDB database at raft/stable
+	err = importBoltStore(filepath.Join(dataDir, "raft", "stable"), stableStore)
+	if err != nil {
+		return err
+	}
 
 	retain := 1
+	if l.config.Raft.SnapshotRetain != 0 {
+		retain = l.config.Raft.SnapshotRetain
+	}
 	snapshotStore, err := raft.NewFileSnapshotStore(
 		filepath.Join(dataDir, "raft"),
 		retain,
@@ -81,7 +111,13 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	}
 
 	maxPool := 5
+	if l.config.Raft.TransportMaxPool != 0 {
+		maxPool = l.config.Raft.TransportMaxPool
+	}
 	timeout := 10 * time.Second
+	if l.config.Raft.TransportTimeout != 0 {
+		timeout = l.config.Raft.TransportTimeout
+	}
 	transport := raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
 		maxPool,
@@ -103,6 +139,15 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if l.config.Raft.CommitTimeout != 0 {
 		config.CommitTimeout = l.config.Raft.CommitTimeout
 	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
 
 	l.raft, err = raft.NewRaft(
 		config,
@@ -128,49 +173,290 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 }
 
 func (l *DistributedLog) Append(record *api_gen.Record) (uint64, error) {
-	res, err := l.apply(
-		AppendRequestType,
+	return l.ProduceAsync(
+		context.Background(),
 		&api_gen.ProduceRequest{Record: record},
+	)()
+}
+
+// ProduceAsync submits the request to Raft without waiting for it to commit
+// and returns a func that waits for the record's offset. Requests are
+// committed in the order they're submitted, so callers can pipeline them and
+// still get their records in order. A request repeating a producer's
+// sequence gets the offset its record was first appended at. ctx's deadline
+// bounds the apply.
+func (l *DistributedLog) ProduceAsync(
+	ctx context.Context,
+	req *api_gen.ProduceRequest,
+) func() (uint64, error) {
+	wait := l.applyAsync(ctx, AppendRequestType, req)
+	return func() (uint64, error) {
+		res, err := wait()
+		if err != nil {
+			return 0, err
+		}
+		return res.(*api_gen.ProduceResponse).Offset, nil
+	}
+}
+
+// BeginTxn begins a transaction and returns its id. Records produced with the
+// id are hidden from read committed consumers until CommitTxn.
+func (l *DistributedLog) BeginTxn() (uint64, error) {
+	res, err := l.apply(BeginTxnRequestType, &api_gen.BeginTxnRequest{
+		BeginTime: timestamppb.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api_gen.BeginTxnResponse).TxnId, nil
+}
+
+// EndTxn commits or aborts the transaction by appending its marker, and
+// returns the marker's offset.
+func (l *DistributedLog) EndTxn(id uint64, commit bool) (uint64, error) {
+	marker := api_gen.TxnMarker_TXN_MARKER_ABORT
+	if commit {
+		marker = api_gen.TxnMarker_TXN_MARKER_COMMIT
+	}
+	now := timestamppb.Now()
+	res, err := l.apply(
+		EndTxnRequestType,
+		&api_gen.Record{
+			TxnId:      id,
+			Marker:     marker,
+			Timestamp:  now,
+			AppendTime: now,
+		},
 	)
 	if err != nil {
 		return 0, err
 	}
-	return res.(*api_gen.ProduceResponse).Offset, nil
+	return res.(*api_gen.EndTxnResponse).Offset, nil
+}
+
+// expireTxns aborts, while this node leads, the transactions open longer than
+// the TxnTimeout, so a producer that dies mid-transaction doesn't hold back
+// read committed consumers forever. Transactions are timed from when the
+// leader that began them did, so a new leader doesn't restart their clocks.
+func (l *DistributedLog) expireTxns() {
+	timeout := defaultTxnTimeout
+	if l.config.TxnTimeout != 0 {
+		timeout = l.config.TxnTimeout
+	}
+	logger := l.logger.Named("txn")
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+		}
+		if !l.IsLeader() {
+			continue
+		}
+		for _, id := range l.txns.expired(time.Now().Add(-timeout)) {
+			_, err := l.EndTxn(id, false)
+			if _, ok := err.(api.ErrTxnNotOpen); ok {
+				continue
+			}
+			if err != nil {
+				logger.Error("failed to abort expired transaction", zap.Uint64("txn_id", id), zap.Error(err))
+				break
+			}
+			logger.Info("aborted expired transaction", zap.Uint64("txn_id", id))
+		}
+	}
+}
+
+// TxnState reports whether the transaction is still open or was aborted.
+func (l *DistributedLog) TxnState(id uint64) (open, aborted bool) {
+	return l.txns.state(id)
+}
+
+// LastSequence returns the last sequence the producer appended, or ok false
+// if it hasn't appended or was forgotten.
+func (l *DistributedLog) LastSequence(producerID string) (seq uint64, ok bool) {
+	return l.producers.last(producerID)
+}
+
+// RegisterSchema adds a version of the request's subject's schema, returning
+// its number. The registry is replicated with the log so every node validates
+// records against the same versions.
+func (l *DistributedLog) RegisterSchema(
+	req *api_gen.RegisterSchemaRequest,
+) (uint32, error) {
+	res, err := l.apply(RegisterSchemaRequestType, req)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api_gen.RegisterSchemaResponse).Version, nil
+}
+
+// SetSchemaCompatibility sets the compatibility the subject's new schema
+// versions are checked with.
+func (l *DistributedLog) SetSchemaCompatibility(
+	req *api_gen.SetSchemaCompatibilityRequest,
+) error {
+	_, err := l.apply(SetSchemaCompatibilityRequestType, req)
+	return err
+}
+
+// GetSchema returns a version of the subject's schema, or its latest for
+// version 0.
+func (l *DistributedLog) GetSchema(
+	subject string,
+	version uint32,
+) (*api_gen.Schema, error) {
+	return l.schemas.Get(subject, version)
+}
+
+// ValidateSchema returns an error unless the value is valid with the version
+// of the subject's schema.
+func (l *DistributedLog) ValidateSchema(
+	subject string,
+	version uint32,
+	value []byte,
+) error {
+	return l.schemas.Validate(subject, version, value)
+}
+
+// Policy returns the ACL policy's rules, each its type followed by its values.
+func (l *DistributedLog) Policy() [][]string {
+	return l.policy.list()
+}
+
+// UpdatePolicy removes and then adds ACL policy rules. The policy is
+// replicated with the log so every node enforces the same rules.
+func (l *DistributedLog) UpdatePolicy(add, remove [][]string) error {
+	_, err := l.apply(UpdatePolicyRequestType, &api_gen.UpdatePolicyRequest{
+		Add:    policyRules(add),
+		Remove: policyRules(remove),
+	})
+	return err
+}
+
+// BootstrapPolicy sets the ACL policy's rules unless it's been updated.
+func (l *DistributedLog) BootstrapPolicy(rules [][]string) error {
+	_, err := l.apply(BootstrapPolicyRequestType, &api_gen.UpdatePolicyRequest{
+		Add: policyRules(rules),
+	})
+	return err
+}
+
+// NotifyPolicy signals ch, without blocking, after each change to the ACL
+// policy.
+func (l *DistributedLog) NotifyPolicy(ch chan<- struct{}) {
+	l.policy.onChange(ch)
+}
+
+func policyRules(rules [][]string) []*api_gen.PolicyRule {
+	pbs := make([]*api_gen.PolicyRule, 0, len(rules))
+	for _, rule := range rules {
+		pb := &api_gen.PolicyRule{}
+		if len(rule) > 0 {
+			pb.Ptype, pb.Values = rule[0], rule[1:]
+		}
+		pbs = append(pbs, pb)
+	}
+	return pbs
+}
+
+func rulesFromPolicy(pbs []*api_gen.PolicyRule) [][]string {
+	rules := make([][]string, 0, len(pbs))
+	for _, pb := range pbs {
+		rules = append(rules, append([]string{pb.Ptype}, pb.Values...))
+	}
+	return rules
 }
 
+// defaultApplyTimeout bounds applies whose context has no deadline.
+const defaultApplyTimeout = 10 * time.Second
+
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	interface{},
 	error,
 ) {
+	return l.applyAsync(context.Background(), reqType, req)()
+}
+
+func (l *DistributedLog) applyAsync(
+	ctx context.Context,
+	reqType RequestType,
+	req proto.Message,
+) func() (interface{}, error) {
+	fail := func(err error) func() (interface{}, error) {
+		return func() (interface{}, error) { return nil, err }
+	}
 	var buf bytes.Buffer
 	_, err := buf.Write([]byte{byte(reqType)})
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	b, err := proto.Marshal(req)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	_, err = buf.Write(b)
 	if err != nil {
-		return nil, err
+		return fail(err)
+	}
+	timeout := defaultApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return fail(context.DeadlineExceeded)
+		}
 	}
-	timeout := 10 * time.Second
 	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	return func() (interface{}, error) {
+		if err := waitFuture(ctx, future); err != nil {
+			return nil, err
+		}
+		res := future.Response()
+		if err, ok := res.(error); ok {
+			return nil, err
+		}
+		return res, nil
 	}
-	res := future.Response()
-	if err, ok := res.(error); ok {
-		return nil, err
+}
+
+// waitFuture waits for the future to complete or ctx to be done, whichever is
+// first.
+func waitFuture(ctx context.Context, future raft.Future) error {
+	if ctx.Done() == nil {
+		return future.Error()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- future.Error()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return res, nil
 }
 
 func (l *DistributedLog) Read(offset uint64) (*api_gen.Record, error) {
 	return l.log.Read(offset)
 }
 
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+// HighWatermark returns the offset after the last record this node has
+// applied. Every applied record is committed.
+func (l *DistributedLog) HighWatermark() uint64 {
+	return l.log.HighWatermark()
+}
+
 func (l *DistributedLog) Join(id, addr string) error {
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
@@ -219,7 +505,42 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	}
 }
 
+// IsLeader reports whether this node is the cluster's leader.
+func (l *DistributedLog) IsLeader() bool {
+	return l.raft.State() == raft.Leader
+}
+
+// HasLeader reports whether this node knows of a leader.
+func (l *DistributedLog) HasLeader() bool {
+	return l.raft.Leader() != ""
+}
+
+// CaughtUp reports whether this node has applied every entry it knows to be
+// committed.
+func (l *DistributedLog) CaughtUp() bool {
+	commit, err := l.CommitIndex()
+	return err == nil && l.raft.AppliedIndex() >= commit
+}
+
+// CommitIndex returns the index of the last Raft entry this node knows to be
+// committed.
+func (l *DistributedLog) CommitIndex() (uint64, error) {
+	commit, err := strconv.ParseUint(l.raft.Stats()["commit_index"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing Raft's commit index: %w", err)
+	}
+	return commit, nil
+}
+
+// Snapshot snapshots the log now rather than waiting for SnapshotInterval.
+// Once the snapshot is persisted Raft compacts its log store, keeping
+// TrailingLogs entries for followers that are slightly behind.
+func (l *DistributedLog) Snapshot() error {
+	return l.raft.Snapshot().Error()
+}
+
 func (l *DistributedLog) Close() error {
+	close(l.closed)
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
@@ -247,88 +568,246 @@ func (l *DistributedLog) GetServers() ([]*api_gen.Server, error) {
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
-	log *Log
+	log       *Log
+	producers *producers
+	txns      *txns
+	schemas   *schema.Registry
+	policy    *policy
+}
+
+func newFSM(log *Log) *fsm {
+	return &fsm{
+		log:       log,
+		producers: newProducers(),
+		txns:      newTxns(),
+		schemas:   schema.NewRegistry(),
+		policy:    newPolicy(),
+	}
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType   RequestType = 0
+	BeginTxnRequestType RequestType = 1
+	EndTxnRequestType   RequestType = 2
+
+	RegisterSchemaRequestType RequestType = 3
+
+	UpdatePolicyRequestType    RequestType = 4
+	BootstrapPolicyRequestType RequestType = 5
+
+	SetSchemaCompatibilityRequestType RequestType = 6
 )
 
 func (l *fsm) Apply(record *raft.Log) interface{} {
 	buf := record.Data
 	reqType := RequestType(buf[0])
+	l.producers.prune(record.Index)
 	switch reqType {
 	case AppendRequestType:
-		return l.applyAppend(buf[1:])
+		return l.applyAppend(buf[1:], record.Index)
+	case BeginTxnRequestType:
+		return l.applyBeginTxn(buf[1:], record.Index)
+	case EndTxnRequestType:
+		return l.applyEndTxn(buf[1:])
+	case RegisterSchemaRequestType:
+		return l.applyRegisterSchema(buf[1:])
+	case SetSchemaCompatibilityRequestType:
+		return l.applySetSchemaCompatibility(buf[1:])
+	case UpdatePolicyRequestType, BootstrapPolicyRequestType:
+		return l.applyUpdatePolicy(reqType, buf[1:])
 	}
 	return nil
 }
 
-func (l *fsm) applyAppend(b []byte) interface{} {
+func (l *fsm) applyAppend(b []byte, index uint64) interface{} {
 	var req api_gen.ProduceRequest
 	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
 	}
+	// only EndTxn writes transaction markers
+	req.Record.Marker = api_gen.TxnMarker_TXN_MARKER_NONE
+	if id := req.Record.TxnId; id != 0 && !l.txns.isOpen(id) {
+		return api.ErrTxnNotOpen{TxnID: id}
+	}
+	if req.ProducerId != "" {
+		offset, ok, err := l.producers.lookup(req.ProducerId, req.Sequence)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return &api_gen.ProduceResponse{Offset: offset}
+		}
+	}
 	offset, err := l.log.Append(req.Record)
 	if err != nil {
 		return err
 	}
+	if req.ProducerId != "" {
+		l.producers.record(req.ProducerId, req.Sequence, offset, index)
+	}
 	return &api_gen.ProduceResponse{Offset: offset}
 }
 
+func (l *fsm) applyBeginTxn(b []byte, index uint64) interface{} {
+	var req api_gen.BeginTxnRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	// entries from before begin times were replicated are timed from when
+	// they're applied
+	began := time.Now()
+	if req.BeginTime != nil {
+		began = req.BeginTime.AsTime()
+	}
+	l.txns.begin(index, began)
+	return &api_gen.BeginTxnResponse{TxnId: index}
+}
+
+func (l *fsm) applyEndTxn(b []byte) interface{} {
+	var marker api_gen.Record
+	if err := proto.Unmarshal(b, &marker); err != nil {
+		return err
+	}
+	if !l.txns.isOpen(marker.TxnId) {
+		return api.ErrTxnNotOpen{TxnID: marker.TxnId}
+	}
+	offset, err := l.log.Append(&marker)
+	if err != nil {
+		return err
+	}
+	l.txns.end(
+		marker.TxnId,
+		marker.Marker == api_gen.TxnMarker_TXN_MARKER_COMMIT,
+		offset,
+	)
+	return &api_gen.EndTxnResponse{Offset: offset}
+}
+
+func (l *fsm) applyRegisterSchema(b []byte) interface{} {
+	var req api_gen.RegisterSchemaRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	version, err := l.schemas.Register(&req)
+	if err != nil {
+		return err
+	}
+	return &api_gen.RegisterSchemaResponse{Version: version}
+}
+
+func (l *fsm) applySetSchemaCompatibility(b []byte) interface{} {
+	var req api_gen.SetSchemaCompatibilityRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if err := l.schemas.SetCompatibility(&req); err != nil {
+		return err
+	}
+	return &api_gen.SetSchemaCompatibilityResponse{}
+}
+
+func (l *fsm) applyUpdatePolicy(reqType RequestType, b []byte) interface{} {
+	var req api_gen.UpdatePolicyRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if reqType == BootstrapPolicyRequestType {
+		l.policy.bootstrap(rulesFromPolicy(req.Add))
+	} else {
+		l.policy.update(rulesFromPolicy(req.Add), rulesFromPolicy(req.Remove))
+	}
+	return &api_gen.UpdatePolicyResponse{}
+}
+
 func (l *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := l.log.Reader()
-	return &snapshot{reader: r}, nil
+	lowest, err := l.log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	l.txns.prune(lowest)
+	return &snapshot{
+		producers: l.producers.clone(),
+		txns:      l.txns.clone(),
+		schemas:   l.schemas.Schemas(),
+		compat:    l.schemas.Compatibilities(),
+		policy:    l.policy.clone(),
+		segments:  l.log.snapshotSegments(),
+	}, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 type snapshot struct {
-	reader io.Reader
+	producers *producers
+	txns      *txns
+	schemas   []*api_gen.Schema
+	compat    []*api_gen.SetSchemaCompatibilityRequest
+	policy    *policy
+	segments  []segmentSnapshot
 }
 
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	if err := s.persist(sink); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
 
+func (s *snapshot) persist(w io.Writer) error {
+	if err := s.producers.writeTo(w); err != nil {
+		return err
+	}
+	if err := s.txns.writeTo(w); err != nil {
+		return err
+	}
+	if err := writeSchemas(w, s.schemas); err != nil {
+		return err
+	}
+	if err := writeCompatibilities(w, s.compat); err != nil {
+		return err
+	}
+	if err := s.policy.writeTo(w); err != nil {
+		return err
+	}
+	return writeSegments(w, s.segments)
+}
+
 func (s *snapshot) Release() {}
 
 func (l *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
-	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
-			return err
-		}
-		record := &api_gen.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
-			return err
-		}
-		if i == 0 {
-			l.log.Config.Segment.InitialOffset = record.Offset
-			if err := l.log.Reset(); err != nil {
-				return err
-			}
-		}
-		if _, err = l.log.Append(record); err != nil {
-			return err
-		}
-		buf.Reset()
+	producers, err := readProducers(r)
+	if err != nil {
+		return err
+	}
+	txns, err := readTxns(r)
+	if err != nil {
+		return err
+	}
+	schemas, err := readSchemas(r)
+	if err != nil {
+		return err
+	}
+	compat, err := readCompatibilities(r)
+	if err != nil {
+		return err
+	}
+	policy, err := readPolicy(r)
+	if err != nil {
+		return err
 	}
+	if err = l.log.restore(r); err != nil {
+		return err
+	}
+	if err = l.schemas.Restore(schemas, compat); err != nil {
+		return err
+	}
+	l.producers.replace(producers)
+	l.txns.replace(txns)
+	l.policy.replace(policy)
 	return nil
 }
 
@@ -357,6 +836,11 @@ func (l *logStore) LastIndex() (uint64, error) {
 
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		// Raft sends followers a snapshot when the entries they need were
+		// compacted
+		return raft.ErrLogNotFound
+	}
 	if err != nil {
 		return err
 	}
@@ -372,6 +856,13 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 }
 func (l *logStore) StoreLogs(records []*raft.Log) error {
 	for _, record := range records {
+		// a follower that installed a snapshot from the leader never stores
+		// the entries before it
+		if record.Index > l.HighWatermark() {
+			if err := l.restartAt(record.Index); err != nil {
+				return err
+			}
+		}
 		if _, err := l.Append(&api_gen.Record{
 			Value: record.Data,
 			Term:  record.Term,
@@ -383,8 +874,19 @@ func (l *logStore) StoreLogs(records []*raft.Log) error {
 	return nil
 }
 
+// DeleteRange is called by Raft to compact the head of the log after a
+// snapshot and to drop conflicting entries from the tail. Compaction only
+// removes whole segments and always keeps the active one, so the store can't
+// be left without a segment to append to.
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.Truncate(max)
+	}
+	return l.truncateFrom(min)
 }
 
 var _ raft.StreamLayer = (*StreamLayer)(nil)
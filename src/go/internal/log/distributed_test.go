@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -48,6 +49,7 @@ func TestMultipleNodes(t *testing.T) {
 
 		l, err := log.NewDistributedLog(dataDir, config)
 		require.NoError(t, err)
+		defer l.Close()
 
 		if i != 0 {
 			err = logs[0].Join(
@@ -85,6 +87,47 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	// schemas registered with the leader are replicated
+	version, err := logs[0].RegisterSchema(&api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Definition: `{"type": "string"}`,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), version)
+	require.Eventually(t, func() bool {
+		return logs[2].ValidateSchema("user", 1, []byte(`"ian"`)) == nil
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	// and so are their compatibilities, which followers check the versions
+	// they're replicated against
+	require.NoError(t, logs[0].SetSchemaCompatibility(&api_gen.SetSchemaCompatibilityRequest{
+		Subject:       "user",
+		Compatibility: api_gen.Compatibility_COMPATIBILITY_NONE,
+	}))
+	version, err = logs[0].RegisterSchema(&api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Definition: `{"type": "number"}`,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), version)
+	require.Eventually(t, func() bool {
+		return logs[2].ValidateSchema("user", 2, []byte(`1`)) == nil
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// so is the ACL policy, and bootstrapping it only sets its first rules
+	changed := make(chan struct{}, 2)
+	logs[2].NotifyPolicy(changed)
+	rules := [][]string{{"p", "root", "log", "produce"}}
+	require.NoError(t, logs[0].BootstrapPolicy(rules))
+	require.NoError(t, logs[0].UpdatePolicy(
+		[][]string{{"g", "root", "admin"}},
+		[][]string{{"p", "root", "log", "produce"}},
+	))
+	require.NoError(t, logs[0].BootstrapPolicy(rules))
+	require.Eventually(t, func() bool {
+		return len(changed) == 2
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	require.Equal(t, [][]string{{"g", "root", "admin"}}, logs[2].Policy())
+
 	// Verify Raft Status
 	servers, err := logs[0].GetServers()
 	require.NoError(t, err)
@@ -120,3 +163,143 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestSnapshotCompactsRaftLog(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID("0")
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.TrailingLogs = 1
+	config.Raft.Bootstrap = true
+	config.Segment.MaxStoreBytes = 64
+
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	for i := 0; i < 10; i++ {
+		_, err := l.Append(&api_gen.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	segments := func() int {
+		files, err := filepath.Glob(filepath.Join(dataDir, "raft", "log", "*.store"))
+		require.NoError(t, err)
+		return len(files)
+	}
+	before := segments()
+	require.Equal(t, uint64(10), l.HighWatermark())
+	commit, err := l.CommitIndex()
+	require.NoError(t, err)
+	require.Greater(t, commit, uint64(10))
+
+	require.NoError(t, l.Snapshot())
+	require.Less(t, segments(), before)
+
+	for i := 0; i < 10; i++ {
+		_, err := l.Read(uint64(i))
+		require.NoError(t, err)
+	}
+	_, err = l.Append(&api_gen.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
+
+func TestSnapshotInstallsOnNewFollower(t *testing.T) {
+	var logs []*log.DistributedLog
+	ports := dynaport.Get(2)
+	for i := 0; i < 2; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.TrailingLogs = 1
+		config.Raft.Bootstrap = i == 0
+		config.Segment.MaxStoreBytes = 64
+
+		l, err := log.NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+		logs = append(logs, l)
+	}
+	require.NoError(t, logs[0].WaitForLeader(3*time.Second))
+
+	for i := 0; i < 10; i++ {
+		_, err := logs[0].Append(&api_gen.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, logs[0].Snapshot())
+
+	// the follower is sent the snapshot, segments and all, since the leader
+	// compacted its log
+	require.NoError(t, logs[0].Join("1", fmt.Sprintf("127.0.0.1:%d", ports[1])))
+	require.Eventually(t, func() bool {
+		return logs[1].HighWatermark() == 10
+	}, 3*time.Second, 50*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		got, err := logs[1].Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+}
+
+func TestTxnTimeout(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID("0")
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	config.TxnTimeout = 200 * time.Millisecond
+
+	l, err := log.NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	id, err := l.BeginTxn()
+	require.NoError(t, err)
+	_, err = l.Append(&api_gen.Record{Value: []byte("hello world"), TxnId: id})
+	require.NoError(t, err)
+	open, _ := l.TxnState(id)
+	require.True(t, open)
+
+	// the leader aborts the transaction once it's been open too long
+	require.Eventually(t, func() bool {
+		open, aborted := l.TxnState(id)
+		return !open && aborted
+	}, 3*time.Second, 50*time.Millisecond)
+	marker, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, api_gen.TxnMarker_TXN_MARKER_ABORT, marker.Marker)
+	_, err = l.EndTxn(id, true)
+	require.Equal(t, api.ErrTxnNotOpen{TxnID: id}, err)
+}
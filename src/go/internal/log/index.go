@@ -7,10 +7,14 @@ import (
 	"github.com/tysonmote/gommap"
 )
 
+// IndexEntryWidth is the size of an index entry, so a segment holds
+// Segment.MaxIndexBytes / IndexEntryWidth records at most.
+const IndexEntryWidth = 12
+
 var (
 	offWidth uint64 = 4
 	posWidth uint64 = 8
-	entWidth        = offWidth + posWidth
+	entWidth uint64 = IndexEntryWidth
 )
 
 type index struct {
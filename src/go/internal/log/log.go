@@ -9,6 +9,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
@@ -22,6 +25,9 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	// lastAppend caches the last record's append time, or is nil when it
+	// needs reading.
+	lastAppend *time.Time
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -79,19 +85,61 @@ func (l *Log) setup() error {
 	return nil
 }
 
+// Append appends the record and returns its offset. A record's append time,
+// if it has one, is moved up to the last record's if it's earlier, so append
+// times never decrease and replicas appending the same records clamp them
+// alike.
 func (l *Log) Append(record *api_gen.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if record.AppendTime != nil {
+		last, err := l.lastAppendTime()
+		if err != nil {
+			return 0, err
+		}
+		if record.AppendTime.AsTime().Before(last) {
+			record.AppendTime = timestamppb.New(last)
+		}
+	}
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	if record.AppendTime != nil {
+		t := record.AppendTime.AsTime()
+		l.lastAppend = &t
+	}
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
 	return off, err
 }
 
+// lastAppendTime returns the last record's append time, or the zero time if
+// it doesn't have one. l.mu must be held.
+func (l *Log) lastAppendTime() (time.Time, error) {
+	if l.lastAppend != nil {
+		return *l.lastAppend, nil
+	}
+	var last time.Time
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s.nextOffset == s.baseOffset {
+			continue
+		}
+		record, err := s.Read(s.nextOffset - 1)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if record.AppendTime != nil {
+			last = record.AppendTime.AsTime()
+		}
+		break
+	}
+	l.lastAppend = &last
+	return last, nil
+}
+
 func (l *Log) Read(off uint64) (*api_gen.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -155,13 +203,22 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// HighWatermark returns the offset after the last record, where the next
+// record will be appended.
+func (l *Log) HighWatermark() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.activeSegment.nextOffset
+}
+
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -173,6 +230,55 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// truncateFrom removes every record at or after off, leaving off as the next
+// offset to be appended.
+func (l *Log) truncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		if s.nextOffset <= off {
+			break
+		}
+		if s.baseOffset < off || i == 0 {
+			if err := s.truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:i]
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.lastAppend = nil
+	return nil
+}
+
+// restartAt removes every record, leaving off as the next offset to be
+// appended.
+func (l *Log) restartAt(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return err
+	}
+	segments := l.segments
+	l.segments = []*segment{s}
+	l.activeSegment = s
+	l.lastAppend = nil
+	for _, s := range segments {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
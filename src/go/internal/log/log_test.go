@@ -4,12 +4,14 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestLog(t *testing.T) {
@@ -21,6 +23,8 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate from":                     testTruncateFrom,
+		"append times never decrease":       testAppendTime,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -122,3 +126,64 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testTruncateFrom(t *testing.T, log *Log) {
+	append := &api_gen.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	err := log.truncateFrom(1)
+	require.NoError(t, err)
+
+	_, err = log.Read(1)
+	require.Error(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	off, err = log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+
+	err = log.Truncate(1)
+	require.NoError(t, err)
+	off, err = log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testAppendTime(t *testing.T, log *Log) {
+	now := time.Now().UTC()
+	appendAt := func(t0 time.Time) time.Time {
+		off, err := log.Append(&api_gen.Record{
+			Value:      []byte("hello world"),
+			AppendTime: timestamppb.New(t0),
+		})
+		require.NoError(t, err)
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		return record.AppendTime.AsTime()
+	}
+	require.Equal(t, now, appendAt(now))
+	// an earlier time, such as from a leader whose clock is behind, is
+	// moved up to the last record's
+	require.Equal(t, now, appendAt(now.Add(-time.Minute)))
+	require.Equal(t, now.Add(time.Second), appendAt(now.Add(time.Second)))
+
+	// including after the log is reopened
+	require.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Second), appendAt(now))
+	// or truncated back to an earlier record
+	require.NoError(t, log.truncateFrom(1))
+	require.Equal(t, now, appendAt(now.Add(-time.Minute)))
+}
@@ -0,0 +1,460 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+var (
+	mirrorSource = tag.MustNewKey("source")
+
+	mirrorLag = stats.Int64(
+		"mirror/lag",
+		"Records the mirror is behind its source",
+		stats.UnitDimensionless,
+	)
+	mirrorRecords = stats.Int64(
+		"mirror/records",
+		"Records mirrored from the source",
+		stats.UnitDimensionless,
+	)
+	mirrorErrors = stats.Int64(
+		"mirror/errors",
+		"Errors mirroring from the source",
+		stats.UnitDimensionless,
+	)
+
+	// MirrorViews are the views of a Mirror's lag, records and errors, tagged
+	// with the source's address.
+	MirrorViews = []*view.View{
+		{
+			Measure:     mirrorLag,
+			TagKeys:     []tag.Key{mirrorSource},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Measure:     mirrorRecords,
+			TagKeys:     []tag.Key{mirrorSource},
+			Aggregation: view.Sum(),
+		},
+		{
+			Measure:     mirrorErrors,
+			TagKeys:     []tag.Key{mirrorSource},
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+var errMirrorOffset = errors.New("mirrored record landed at a different offset")
+
+// checkpointKey is the key the mirror's next source offset is stored under.
+var checkpointKey = []byte("checkpoint")
+
+// Mirror copies the log of another cluster into the local one. Where the
+// Replicator follows peers of the same cluster, a mirror follows one source
+// it's configured with and keeps reconnecting while the source is
+// unreachable.
+//
+// The mirror produces with a producer id and the source offset as the
+// sequence. Each time it becomes active it resumes after the last sequence
+// the local log appended for its producer id, which is replicated, so a node
+// that takes over mirroring carries on where the previous one stopped.
+type Mirror struct {
+	// SourceAddr is the RPC address of the cluster being mirrored.
+	SourceAddr  string
+	DialOptions []grpc.DialOption
+	LocalServer api_gen.LogClient
+	// CheckpointFile stores the next source offset to mirror. It's only
+	// resumed from if the local log has forgotten the mirror's producer id.
+	CheckpointFile string
+	// CheckpointInterval is how often the checkpoint is saved while
+	// mirroring. It's also saved when the mirror stops.
+	CheckpointInterval time.Duration
+	// PreserveOffsets stops the mirror if a record doesn't land at its
+	// source offset. Otherwise records get the local log's next offset. The
+	// offsets of the source's transaction markers and aborted records, which
+	// aren't mirrored, are filled with aborted transactions' markers so
+	// later records keep their offsets.
+	PreserveOffsets bool
+	// ProducerID identifies the mirror's records for deduplication and
+	// defaults to the source's address.
+	ProducerID string
+	// LastSequence returns the last sequence the local log appended for a
+	// producer, e.g. DistributedLog.LastSequence.
+	LastSequence func(producerID string) (seq uint64, ok bool)
+	// Active reports whether this node should mirror, e.g. because it's the
+	// leader. Inactive mirrors wait. Nil means always active.
+	Active func() bool
+	// MinBackoff and MaxBackoff bound the wait between reconnects.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// LagInterval is how often the mirror measures its lag.
+	LagInterval time.Duration
+
+	logger     *zap.Logger
+	ctx        context.Context
+	checkpoint *stableStore
+
+	mu     sync.Mutex
+	next   uint64
+	saved  uint64
+	lag    uint64
+	closed bool
+	close  chan struct{}
+	done   chan struct{}
+}
+
+// Start loads the checkpoint and starts mirroring in the background.
+func (m *Mirror) Start() error {
+	m.init()
+	var err error
+	if m.checkpoint, err = newStableStore(m.CheckpointFile); err != nil {
+		return err
+	}
+	m.next, err = m.checkpoint.GetUint64(checkpointKey)
+	if err != nil && err != errKeyNotFound {
+		return err
+	}
+	m.saved = m.next
+	go m.run()
+	return nil
+}
+
+// Checkpoint returns the next source offset to mirror, which is saved every
+// CheckpointInterval.
+func (m *Mirror) Checkpoint() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.next
+}
+
+// Lag returns how many records the mirror was behind its source when last
+// measured.
+func (m *Mirror) Lag() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lag
+}
+
+func (m *Mirror) run() {
+	defer close(m.done)
+	backoff := newBackoff(m.MinBackoff, m.MaxBackoff)
+	for {
+		if m.Active == nil || m.Active() {
+			progressed, err := m.mirror()
+			switch {
+			case m.isClosed():
+				return
+			case errors.Is(err, errMirrorOffset):
+				m.logError(err, "stopping mirror")
+				return
+			case err != nil:
+				m.logError(err, "failed to mirror")
+			}
+			if progressed {
+				backoff.reset()
+			}
+		}
+		if !backoff.wait(m.close) {
+			return
+		}
+	}
+}
+
+// mirror streams records from the source into the local log until either
+// fails, the node stops being active, or the mirror is closed.
+func (m *Mirror) mirror() (progressed bool, err error) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	defer func() {
+		if saveErr := m.saveCheckpoint(); err == nil {
+			err = saveErr
+		}
+	}()
+	go func() {
+		select {
+		case <-m.close:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// localNext is the local log's next offset, which records preserving
+	// their offsets are produced at
+	var localNext uint64
+	if m.PreserveOffsets {
+		res, err := m.LocalServer.GetOffsets(ctx, &api_gen.GetOffsetsRequest{})
+		if err != nil {
+			return false, err
+		}
+		localNext = res.HighWatermark
+	}
+	m.resume(localNext)
+
+	cc, err := grpc.DialContext(ctx, m.SourceAddr, m.DialOptions...)
+	if err != nil {
+		return false, err
+	}
+	defer cc.Close()
+	source := api_gen.NewLogClient(cc)
+
+	// records in transactions are only mirrored once committed, and without
+	// their transaction since it only exists in the source
+	stream, err := source.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Offset:    m.Checkpoint(),
+		Isolation: api_gen.Isolation_READ_COMMITTED,
+	})
+	if err != nil {
+		return false, err
+	}
+	go measureLag(ctx, source, m.LagInterval, m.Checkpoint, m.reportLag)
+
+	ticker := time.NewTicker(m.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return progressed, err
+		}
+		if m.Active != nil && !m.Active() {
+			return progressed, nil
+		}
+		if m.PreserveOffsets && res.Record.Offset > localNext {
+			if err = m.fillGap(ctx, localNext, res.Record.Offset); err != nil {
+				return progressed, err
+			}
+		}
+		offset, err := m.produce(ctx, res.Record)
+		if err != nil {
+			return progressed, err
+		}
+		if offset+1 > localNext {
+			localNext = offset + 1
+		}
+		progressed = true
+		stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(mirrorSource, m.SourceAddr)},
+			mirrorRecords.M(1),
+		)
+		select {
+		case <-ticker.C:
+			if err = m.saveCheckpoint(); err != nil {
+				return progressed, err
+			}
+		default:
+		}
+	}
+}
+
+// resume moves the next source offset past what the local log holds: the
+// last record appended with the mirror's producer id or, with offsets
+// preserved, the local log's next offset.
+func (m *Mirror) resume(localNext uint64) {
+	next := localNext
+	if m.LastSequence != nil {
+		if last, ok := m.LastSequence(m.ProducerID); ok && last+1 > next {
+			next = last + 1
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if next > m.next {
+		m.next = next
+	}
+}
+
+// fillGap fills the local log's offsets from next up to the source offset,
+// which read committed consumers skip as they skip the source's markers and
+// aborted records at those offsets. Each is filled with the marker of an
+// aborted transaction that has no records, so nothing is appended that
+// records are validated against schemas for.
+func (m *Mirror) fillGap(ctx context.Context, next, offset uint64) error {
+	for ; next < offset; next++ {
+		txn, err := m.LocalServer.BeginTxn(ctx, &api_gen.BeginTxnRequest{})
+		if err != nil {
+			return err
+		}
+		res, err := m.LocalServer.AbortTxn(ctx, &api_gen.EndTxnRequest{TxnId: txn.TxnId})
+		if err != nil {
+			return err
+		}
+		if res.Offset != next {
+			return fmt.Errorf(
+				"%w: filling source offset %d landed at local offset %d",
+				errMirrorOffset,
+				next,
+				res.Offset,
+			)
+		}
+	}
+	return nil
+}
+
+// produce mirrors the record, returning the local offset it's at.
+func (m *Mirror) produce(ctx context.Context, record *api_gen.Record) (uint64, error) {
+	res, err := m.LocalServer.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{
+			Value:     record.Value,
+			Timestamp: record.Timestamp,
+			Key:       record.Key,
+			Headers:   record.Headers,
+		},
+		ProducerId: m.ProducerID,
+		Sequence:   record.Offset,
+	})
+	var offset uint64
+	switch status.Code(err) {
+	case codes.OK:
+		if m.PreserveOffsets && res.Offset != record.Offset {
+			return 0, fmt.Errorf(
+				"%w: source offset %d, local offset %d",
+				errMirrorOffset,
+				record.Offset,
+				res.Offset,
+			)
+		}
+		offset = res.Offset
+	default:
+		return 0, err
+	}
+	m.mu.Lock()
+	m.next = record.Offset + 1
+	m.mu.Unlock()
+	return offset, nil
+}
+
+func (m *Mirror) reportLag(lag uint64) {
+	m.mu.Lock()
+	m.lag = lag
+	m.mu.Unlock()
+	stats.RecordWithTags(m.ctx,
+		[]tag.Mutator{tag.Upsert(mirrorSource, m.SourceAddr)},
+		mirrorLag.M(int64(lag)),
+	)
+}
+
+// saveCheckpoint saves the next source offset if it's moved since it was
+// last saved.
+func (m *Mirror) saveCheckpoint() error {
+	m.mu.Lock()
+	next, saved := m.next, m.saved
+	m.mu.Unlock()
+	if next == saved {
+		return nil
+	}
+	if err := m.checkpoint.SetUint64(checkpointKey, next); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saved = next
+	return nil
+}
+
+// measureLag periodically reports how far the source's high-water mark is
+// past next.
+func measureLag(
+	ctx context.Context,
+	source api_gen.LogClient,
+	interval time.Duration,
+	next func() uint64,
+	report func(lag uint64),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		from := next()
+		res, err := source.GetOffsets(ctx, &api_gen.GetOffsetsRequest{})
+		if err == nil {
+			var lag uint64
+			if res.HighWatermark > from {
+				lag = res.HighWatermark - from
+			}
+			report(lag)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the mirror and waits for it to finish.
+func (m *Mirror) Close() error {
+	m.mu.Lock()
+	m.init()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.close)
+	started := m.checkpoint != nil
+	m.mu.Unlock()
+	if started {
+		<-m.done
+	}
+	return nil
+}
+
+func (m *Mirror) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *Mirror) init() {
+	if m.logger == nil {
+		m.logger = zap.L().Named("mirror")
+	}
+	if m.ctx == nil {
+		m.ctx = context.Background()
+	}
+	if m.ProducerID == "" {
+		m.ProducerID = "mirror:" + m.SourceAddr
+	}
+	if m.MinBackoff == 0 {
+		m.MinBackoff = 100 * time.Millisecond
+	}
+	if m.MaxBackoff == 0 {
+		m.MaxBackoff = 30 * time.Second
+	}
+	if m.LagInterval == 0 {
+		m.LagInterval = 10 * time.Second
+	}
+	if m.CheckpointInterval == 0 {
+		m.CheckpointInterval = time.Second
+	}
+	if m.close == nil {
+		m.close = make(chan struct{})
+	}
+	if m.done == nil {
+		m.done = make(chan struct{})
+	}
+}
+
+func (m *Mirror) logError(err error, msg string) {
+	stats.RecordWithTags(m.ctx,
+		[]tag.Mutator{tag.Upsert(mirrorSource, m.SourceAddr)},
+		mirrorErrors.M(1),
+	)
+	m.logger.Error(
+		msg,
+		zap.String("source", m.SourceAddr),
+		zap.Error(err),
+	)
+}
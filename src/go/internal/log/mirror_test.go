@@ -0,0 +1,185 @@
+package log_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/log"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/server"
+)
+
+func TestMirror(t *testing.T) {
+	dir, err := os.MkdirTemp("", "mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "source"), 0755))
+	source, err := log.NewLog(filepath.Join(dir, "source"), log.Config{})
+	require.NoError(t, err)
+	sourceAddr := serve(t, source)
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID("0")
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	local, err := log.NewDistributedLog(filepath.Join(dir, "local"), config)
+	require.NoError(t, err)
+	defer local.Close()
+	require.NoError(t, local.WaitForLeader(3*time.Second))
+
+	cc, err := grpc.Dial(
+		serve(t, local),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := source.Append(&api_gen.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	newMirror := func(checkpoint string, active func() bool) *log.Mirror {
+		m := &log.Mirror{
+			SourceAddr: sourceAddr,
+			DialOptions: []grpc.DialOption{
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			},
+			LocalServer:    api_gen.NewLogClient(cc),
+			CheckpointFile: filepath.Join(dir, checkpoint),
+			LastSequence:   local.LastSequence,
+			Active:         active,
+			MinBackoff:     10 * time.Millisecond,
+			MaxBackoff:     100 * time.Millisecond,
+			LagInterval:    10 * time.Millisecond,
+		}
+		return m
+	}
+	startMirror := func() *log.Mirror {
+		m := newMirror("checkpoint", local.IsLeader)
+		m.PreserveOffsets = true
+		require.NoError(t, m.Start())
+		return m
+	}
+	requireMirrored := func(m *log.Mirror, n uint64) {
+		require.Eventually(t, func() bool {
+			return m.Checkpoint() == n
+		}, 3*time.Second, 10*time.Millisecond)
+		for off := uint64(0); off < n; off++ {
+			record, err := local.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), record.Value)
+		}
+		_, err := local.Read(n)
+		require.Error(t, err)
+	}
+
+	produce(3)
+	m := startMirror()
+	requireMirrored(m, 3)
+	require.Eventually(t, func() bool {
+		return m.Lag() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, m.Close())
+
+	// a restarted mirror resumes from its checkpoint
+	produce(2)
+	m = startMirror()
+	requireMirrored(m, 5)
+	require.NoError(t, m.Close())
+
+	// a mirror that becomes active again resumes where the mirror active
+	// meanwhile stopped, as a node regaining leadership does, rather than
+	// from its own checkpoint
+	var firstActive, secondActive atomic.Bool
+	first := newMirror("first", firstActive.Load)
+	second := newMirror("second", secondActive.Load)
+	require.NoError(t, first.Start())
+	require.NoError(t, second.Start())
+	firstActive.Store(true)
+	requireMirrored(first, 5)
+	firstActive.Store(false)
+	secondActive.Store(true)
+	produce(40)
+	requireMirrored(second, 45)
+	secondActive.Store(false)
+	firstActive.Store(true)
+	produce(1)
+	requireMirrored(first, 46)
+	require.NoError(t, first.Close())
+	require.NoError(t, second.Close())
+
+	// the offsets of the source's markers, which aren't mirrored, are filled
+	// so the records after them keep their offsets
+	for i := 0; i < 2; i++ {
+		_, err = source.Append(&api_gen.Record{
+			TxnId:  1,
+			Marker: api_gen.TxnMarker_TXN_MARKER_COMMIT,
+		})
+		require.NoError(t, err)
+	}
+	produce(1)
+	m = startMirror()
+	require.Eventually(t, func() bool {
+		return m.Checkpoint() == 49
+	}, 3*time.Second, 10*time.Millisecond)
+	record, err := local.Read(48)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	// with markers of aborted transactions, which aren't validated against
+	// schemas as records are
+	for off := uint64(46); off < 48; off++ {
+		marker, err := local.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, api_gen.TxnMarker_TXN_MARKER_ABORT, marker.Marker)
+		_, aborted := local.TxnState(marker.TxnId)
+		require.True(t, aborted)
+	}
+	require.NoError(t, m.Close())
+}
+
+func serve(t *testing.T, commitLog server.CommitLog) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveOn(t, ln, commitLog)
+	return ln.Addr().String()
+}
+
+func serveOn(t *testing.T, ln net.Listener, commitLog server.CommitLog) {
+	t.Helper()
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:  commitLog,
+		Authorizer: allowAll{},
+	})
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	t.Cleanup(srv.Stop)
+}
+
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// policy is the ACL policy replicated with the log. Each rule is its type, p
+// or g, followed by its values, as in a casbin policy file.
+type policy struct {
+	mu    sync.RWMutex
+	rules map[string][]string
+	// updated is whether the policy has been updated, after which
+	// bootstrapping it does nothing.
+	updated bool
+	notify  []chan<- struct{}
+}
+
+func newPolicy() *policy {
+	return &policy{rules: make(map[string][]string)}
+}
+
+func ruleKey(rule []string) string {
+	return strings.Join(rule, ", ")
+}
+
+func (p *policy) update(add, remove [][]string) {
+	p.mu.Lock()
+	for _, rule := range remove {
+		delete(p.rules, ruleKey(rule))
+	}
+	for _, rule := range add {
+		p.rules[ruleKey(rule)] = rule
+	}
+	p.updated = true
+	p.mu.Unlock()
+	p.changed()
+}
+
+// bootstrap sets the rules unless the policy has been updated, so a node
+// seeding the policy when it starts doesn't undo later updates.
+func (p *policy) bootstrap(rules [][]string) {
+	p.mu.RLock()
+	updated := p.updated
+	p.mu.RUnlock()
+	if !updated {
+		p.update(rules, nil)
+	}
+}
+
+// list returns the rules in order.
+func (p *policy) list() [][]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	keys := make([]string, 0, len(p.rules))
+	for key := range p.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rules := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		rules = append(rules, p.rules[key])
+	}
+	return rules
+}
+
+// onChange signals ch after each change to the policy.
+func (p *policy) onChange(ch chan<- struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.notify = append(p.notify, ch)
+}
+
+// changed signals the policy's watchers without blocking, since it's called
+// as the FSM applies changes. A watcher that hasn't received its last signal
+// isn't sent another, so it should check the policy once for every change
+// it was signaled since.
+func (p *policy) changed() {
+	p.mu.RLock()
+	notify := p.notify
+	p.mu.RUnlock()
+	for _, ch := range notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *policy) clone() *policy {
+	c := newPolicy()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for key, rule := range p.rules {
+		c.rules[key] = rule
+	}
+	c.updated = p.updated
+	return c
+}
+
+// writeTo writes whether the policy was updated and the rule count, followed
+// by each rule's field count and its length prefixed fields.
+func (p *policy) writeTo(w io.Writer) error {
+	if err := binary.Write(w, enc, p.updated); err != nil {
+		return err
+	}
+	rules := p.list()
+	if err := binary.Write(w, enc, uint64(len(rules))); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := binary.Write(w, enc, uint64(len(rule))); err != nil {
+			return err
+		}
+		for _, field := range rule {
+			if err := binary.Write(w, enc, uint64(len(field))); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readPolicy(r io.Reader) (*policy, error) {
+	p := newPolicy()
+	if err := binary.Read(r, enc, &p.updated); err != nil {
+		return nil, err
+	}
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		var fields uint64
+		if err := binary.Read(r, enc, &fields); err != nil {
+			return nil, err
+		}
+		rule := make([]string, fields)
+		for j := range rule {
+			var size uint64
+			if err := binary.Read(r, enc, &size); err != nil {
+				return nil, err
+			}
+			b := make([]byte, size)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			rule[j] = string(b)
+		}
+		p.rules[ruleKey(rule)] = rule
+	}
+	return p, nil
+}
+
+// replace swaps in the policy restored from a snapshot.
+func (p *policy) replace(o *policy) {
+	p.mu.Lock()
+	p.rules, p.updated = o.rules, o.updated
+	p.mu.Unlock()
+	p.changed()
+}
@@ -0,0 +1,190 @@
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
+)
+
+// producerHistoryLen is how many of a producer's most recent sequences are
+// remembered. A producer that pipelines requests can retry any of its last
+// producerHistoryLen requests and get the original offsets back.
+const producerHistoryLen = 32
+
+// A producer that appends nothing for producerIdleEntries Raft entries is
+// forgotten, so its retries are appended again. Idle producers are pruned
+// every producerPruneInterval entries. Both count Raft indexes rather than
+// time so every node forgets the same producers at the same entry.
+const (
+	producerIdleEntries   = 1 << 20
+	producerPruneInterval = 1 << 12
+)
+
+type produced struct {
+	Sequence uint64
+	Offset   uint64
+}
+
+type producer struct {
+	// lastSeen is the Raft index of the producer's latest append.
+	lastSeen uint64
+	// history holds the sequences most recently appended, oldest first.
+	history []produced
+}
+
+// producers tracks what each producer recently appended.
+type producers struct {
+	mu sync.RWMutex
+	m  map[string]*producer
+}
+
+func newProducers() *producers {
+	return &producers{m: make(map[string]*producer)}
+}
+
+// lookup returns the offset a sequence was appended at, or ok false if the
+// sequence is new. A sequence that isn't new but isn't one of those
+// remembered is out of order: it may have never been appended.
+func (p *producers) lookup(id string, seq uint64) (offset uint64, ok bool, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var history []produced
+	if pr := p.m[id]; pr != nil {
+		history = pr.history
+	}
+	if len(history) == 0 || seq > history[len(history)-1].Sequence {
+		return 0, false, nil
+	}
+	for _, h := range history {
+		if h.Sequence == seq {
+			return h.Offset, true, nil
+		}
+	}
+	return 0, false, api.ErrStaleSequence{
+		ProducerID:   id,
+		Sequence:     seq,
+		LastSequence: history[len(history)-1].Sequence,
+	}
+}
+
+// last returns the producer's last appended sequence, or ok false if it
+// hasn't appended or was forgotten.
+func (p *producers) last(id string) (seq uint64, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pr := p.m[id]
+	if pr == nil || len(pr.history) == 0 {
+		return 0, false
+	}
+	return pr.history[len(pr.history)-1].Sequence, true
+}
+
+// record records the sequence's offset, appended by the entry at index.
+func (p *producers) record(id string, seq, offset, index uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr := p.m[id]
+	if pr == nil {
+		pr = &producer{}
+		p.m[id] = pr
+	}
+	pr.lastSeen = index
+	pr.history = append(pr.history, produced{Sequence: seq, Offset: offset})
+	if len(pr.history) > producerHistoryLen {
+		pr.history = pr.history[len(pr.history)-producerHistoryLen:]
+	}
+}
+
+// prune forgets the producers idle for producerIdleEntries if the entry at
+// index is one they're pruned at.
+func (p *producers) prune(index uint64) {
+	if index%producerPruneInterval != 0 || index < producerIdleEntries {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, pr := range p.m {
+		if pr.lastSeen < index-producerIdleEntries {
+			delete(p.m, id)
+		}
+	}
+}
+
+func (p *producers) clone() *producers {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	c := newProducers()
+	for id, pr := range p.m {
+		c.m[id] = &producer{
+			lastSeen: pr.lastSeen,
+			history:  append([]produced(nil), pr.history...),
+		}
+	}
+	return c
+}
+
+func (p *producers) writeTo(w io.Writer) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := binary.Write(w, enc, uint64(len(p.m))); err != nil {
+		return err
+	}
+	for id, pr := range p.m {
+		if err := binary.Write(w, enc, uint64(len(id))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, id); err != nil {
+			return err
+		}
+		if err := binary.Write(w, enc, pr.lastSeen); err != nil {
+			return err
+		}
+		if err := binary.Write(w, enc, uint64(len(pr.history))); err != nil {
+			return err
+		}
+		if err := binary.Write(w, enc, pr.history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readProducers(r io.Reader) (*producers, error) {
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return nil, err
+	}
+	p := newProducers()
+	for i := uint64(0); i < n; i++ {
+		var size uint64
+		if err := binary.Read(r, enc, &size); err != nil {
+			return nil, err
+		}
+		id := make([]byte, size)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return nil, err
+		}
+		pr := &producer{}
+		if err := binary.Read(r, enc, &pr.lastSeen); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, enc, &size); err != nil {
+			return nil, err
+		}
+		pr.history = make([]produced, size)
+		if err := binary.Read(r, enc, pr.history); err != nil {
+			return nil, err
+		}
+		p.m[string(id)] = pr
+	}
+	return p, nil
+}
+
+// replace swaps in the producers restored from a snapshot.
+func (p *producers) replace(o *producers) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.m = o.m
+}
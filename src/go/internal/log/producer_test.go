@@ -0,0 +1,87 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+func TestIdempotentProduce(t *testing.T) {
+	dir, err := os.MkdirTemp("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	f := newFSM(l)
+
+	var index uint64
+	produce := func(f *fsm, id string, seq uint64) interface{} {
+		b, err := proto.Marshal(&api_gen.ProduceRequest{
+			Record:     &api_gen.Record{Value: []byte("hello world")},
+			ProducerId: id,
+			Sequence:   seq,
+		})
+		require.NoError(t, err)
+		data := append([]byte{byte(AppendRequestType)}, b...)
+		index++
+		return f.Apply(&raft.Log{Index: index, Data: data})
+	}
+	offset := func(res interface{}) uint64 {
+		return res.(*api_gen.ProduceResponse).Offset
+	}
+
+	require.Equal(t, uint64(0), offset(produce(f, "a", 0)))
+	require.Equal(t, uint64(1), offset(produce(f, "a", 1)))
+	require.Equal(t, uint64(2), offset(produce(f, "b", 0)))
+	// retries return the original offsets
+	require.Equal(t, uint64(0), offset(produce(f, "a", 0)))
+	require.Equal(t, uint64(1), offset(produce(f, "a", 1)))
+	// requests without a producer id are always appended
+	require.Equal(t, uint64(3), offset(produce(f, "", 0)))
+	require.Equal(t, uint64(4), offset(produce(f, "", 0)))
+
+	for seq := uint64(2); seq < producerHistoryLen+2; seq++ {
+		produce(f, "a", seq)
+	}
+	last, ok := f.producers.last("a")
+	require.True(t, ok)
+	require.Equal(t, uint64(producerHistoryLen+1), last)
+	stale := produce(f, "a", 0)
+	require.Equal(t, api.ErrStaleSequence{
+		ProducerID:   "a",
+		Sequence:     0,
+		LastSequence: producerHistoryLen + 1,
+	}, stale)
+	// whether the sequence was appended isn't known
+	require.Equal(t, codes.FailedPrecondition, status.Code(stale.(error)))
+
+	// the producers are snapshotted with the log
+	snap := persistSnapshot(t, f)
+	dir, err = os.MkdirTemp("", "producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	restored := newFSM(l)
+	require.NoError(t, restored.Restore(snap.reader()))
+	require.Equal(t, uint64(2), offset(produce(restored, "b", 0)))
+
+	// idle producers are forgotten, so their retries are appended again
+	first := offset(produce(restored, "b", 1))
+	kept := index + producerIdleEntries - (index+producerIdleEntries)%producerPruneInterval
+	forgotten := kept + producerPruneInterval
+	restored.producers.prune(forgotten + 1)
+	restored.producers.prune(kept)
+	require.Equal(t, first, offset(produce(restored, "b", 1)))
+	restored.producers.prune(forgotten)
+	require.Empty(t, restored.producers.m)
+	require.Equal(t, first+1, offset(produce(restored, "b", 1)))
+}
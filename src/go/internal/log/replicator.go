@@ -3,25 +3,91 @@ package log
 import (
 	"context"
 	"sync"
+	"time"
 
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
 )
 
+var (
+	replicatorPeer = tag.MustNewKey("peer")
+
+	replicatorLag = stats.Int64(
+		"replicator/lag",
+		"Records the replicator is behind a peer",
+		stats.UnitDimensionless,
+	)
+	replicatorErrors = stats.Int64(
+		"replicator/errors",
+		"Errors replicating from a peer",
+		stats.UnitDimensionless,
+	)
+
+	// ReplicatorViews are the views of a Replicator's lag and errors, tagged
+	// with the peer's name.
+	ReplicatorViews = []*view.View{
+		{
+			Measure:     replicatorLag,
+			TagKeys:     []tag.Key{replicatorPeer},
+			Aggregation: view.LastValue(),
+		},
+		{
+			Measure:     replicatorErrors,
+			TagKeys:     []tag.Key{replicatorPeer},
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+const defaultReplicatorBatchSize = 64
+
+// Replicator copies the records of the servers that join into the local
+// server. It remembers how far it got with each server so reconnecting, the
+// server leaving and joining again, or with an OffsetsFile a restart, resumes
+// where it left off, and it retries failures with exponential backoff until
+// the server leaves. With LastSequence it resumes after the last record the
+// local server appended instead, if that's further.
 type Replicator struct {
 	Dialoptions []grpc.DialOption
 	LocalServer api_gen.LogClient
+	// OffsetsFile stores the next offset to replicate from each server,
+	// saved after every batch. Offsets are only kept in memory without one.
+	OffsetsFile string
+	// LastSequence returns the last sequence the local server appended for
+	// a producer, e.g. DistributedLog.LastSequence. The replicator produces
+	// each server's records with their offsets as sequences.
+	LastSequence func(producerID string) (seq uint64, ok bool)
+	// BatchSize bounds how many records are buffered from a server and
+	// produced at once. The replicator stops reading from a server while a
+	// batch is being produced.
+	BatchSize int
+	// MinBackoff and MaxBackoff bound the wait between retries.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// LagInterval is how often the replicator measures its lag.
+	LagInterval time.Duration
 
 	logger *zap.Logger
+	store  *stableStore
 
 	mu      sync.Mutex
-	servers map[string]chan struct{}
+	servers map[string]*replica
+	offsets map[string]uint64
+	lags    map[string]uint64
 	closed  bool
 	close   chan struct{}
 }
 
+type replica struct {
+	leave chan struct{}
+	done  chan struct{}
+}
+
 func (r *Replicator) Join(name, addr string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -34,91 +100,299 @@ func (r *Replicator) Join(name, addr string) error {
 	if _, ok := r.servers[name]; ok {
 		return nil
 	}
+	if err := r.loadOffset(name); err != nil {
+		return err
+	}
+
+	rep := &replica{
+		leave: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	r.servers[name] = rep
 
-	r.servers[name] = make(chan struct{})
+	go r.replicate(name, addr, rep)
 
-	go r.replicate(addr, r.servers[name])
+	return nil
+}
 
+// loadOffset loads the server's offset from the OffsetsFile the first time it
+// joins.
+func (r *Replicator) loadOffset(name string) error {
+	if r.OffsetsFile == "" {
+		return nil
+	}
+	if _, ok := r.offsets[name]; ok {
+		return nil
+	}
+	if r.store == nil {
+		store, err := newStableStore(r.OffsetsFile)
+		if err != nil {
+			return err
+		}
+		r.store = store
+	}
+	next, err := r.store.GetUint64([]byte(name))
+	if err != nil && err != errKeyNotFound {
+		return err
+	}
+	r.offsets[name] = next
 	return nil
 }
 
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
-	cc, err := grpc.Dial(addr, r.Dialoptions...)
+// Offset returns the next offset to replicate from the named server.
+func (r *Replicator) Offset(name string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offsets[name]
+}
+
+// Lag returns how many records the replicator was behind the named server
+// when last measured.
+func (r *Replicator) Lag(name string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lags[name]
+}
+
+func (r *Replicator) replicate(name, addr string, rep *replica) {
+	defer close(rep.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	go func() {
+		defer close(stop)
+		select {
+		case <-r.close:
+		case <-rep.leave:
+		}
+		cancel()
+	}()
+
+	backoff := newBackoff(r.MinBackoff, r.MaxBackoff)
+	for {
+		progressed, err := r.session(ctx, name, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.logError(err, "failed to replicate", name, addr)
+		}
+		if progressed {
+			backoff.reset()
+		}
+		if !backoff.wait(stop) {
+			return
+		}
+	}
+}
+
+// session replicates from addr over one connection until it fails or ctx is
+// canceled.
+func (r *Replicator) session(
+	ctx context.Context,
+	name, addr string,
+) (progressed bool, err error) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cc, err := grpc.DialContext(ctx, addr, r.Dialoptions...)
 	if err != nil {
-		r.logError(err, "failed to dial", addr)
-		return
+		return false, err
 	}
 	defer cc.Close()
-
 	client := api_gen.NewLogClient(cc)
 
-	ctx := context.Background()
+	r.resume(name)
 	stream, err := client.ConsumeStream(ctx,
 		&api_gen.ConsumeRequest{
-			Offset: 0,
+			Offset: r.Offset(name),
 		},
 	)
 	if err != nil {
-		r.logError(err, "failed to consume", addr)
-		return
+		return false, err
+	}
+	produce, err := r.LocalServer.ProduceStream(ctx)
+	if err != nil {
+		return false, err
 	}
 
-	records := make(chan *api_gen.Record)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		measureLag(ctx, client, r.LagInterval,
+			func() uint64 { return r.Offset(name) },
+			func(lag uint64) { r.reportLag(ctx, name, lag) },
+		)
+	}()
 
+	records := make(chan *api_gen.Record, r.BatchSize)
+	recvErr := make(chan error, 1)
 	go func() {
+		defer wg.Done()
+		defer close(records)
 		for {
 			recv, err := stream.Recv()
 			if err != nil {
-				r.logError(err, "failed to receive", addr)
+				recvErr <- err
+				return
+			}
+			select {
+			case records <- recv.Record:
+			case <-ctx.Done():
 				return
 			}
-			records <- recv.Record
 		}
 	}()
 
+	batch := make([]*api_gen.Record, 0, r.BatchSize)
 	for {
-		select {
-		case <-r.close:
-			return
-		case <-leave:
-			return
-		case record := <-records:
-			_, err = r.LocalServer.Produce(ctx,
-				&api_gen.ProduceRequest{
-					Record: record,
-				},
-			)
-			if err != nil {
-				r.logError(err, "failed to produce", addr)
-				return
+		record, ok := <-records
+		if !ok {
+			return progressed, <-recvErr
+		}
+		batch = append(batch[:0], record)
+	fill:
+		for len(batch) < r.BatchSize {
+			select {
+			case record, ok := <-records:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, record)
+			default:
+				break fill
 			}
 		}
+		n, err := r.produceBatch(produce, name, batch)
+		if n > 0 {
+			progressed = true
+			if saveErr := r.saveOffset(name); err == nil {
+				err = saveErr
+			}
+		}
+		if err != nil {
+			return progressed, err
+		}
 	}
 }
 
-func (r *Replicator) Leave(name string) error {
+// produceBatch sends every record in the batch before waiting for their
+// offsets, returning how many were replicated.
+func (r *Replicator) produceBatch(
+	stream api_gen.Log_ProduceStreamClient,
+	name string,
+	batch []*api_gen.Record,
+) (int, error) {
+	for _, record := range batch {
+		err := stream.Send(&api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value:     record.Value,
+				Timestamp: record.Timestamp,
+				Key:       record.Key,
+				Headers:   record.Headers,
+			},
+			ProducerId: replicatorProducerID(name),
+			Sequence:   record.Offset,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for i, record := range batch {
+		if _, err := stream.Recv(); err != nil {
+			return i, err
+		}
+		r.setOffset(name, record.Offset+1)
+	}
+	return len(batch), nil
+}
+
+func replicatorProducerID(name string) string {
+	return "replicator:" + name
+}
+
+// resume moves the server's offset past the last record the local server
+// appended from it.
+func (r *Replicator) resume(name string) {
+	if r.LastSequence == nil {
+		return
+	}
+	last, ok := r.LastSequence(replicatorProducerID(name))
+	if !ok {
+		return
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if last+1 > r.offsets[name] {
+		r.offsets[name] = last + 1
+	}
+}
+
+func (r *Replicator) setOffset(name string, next uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.offsets[name] = next
+}
+
+// saveOffset saves the server's offset to the OffsetsFile.
+func (r *Replicator) saveOffset(name string) error {
+	if r.OffsetsFile == "" {
+		return nil
+	}
+	r.mu.Lock()
+	store, next := r.store, r.offsets[name]
+	r.mu.Unlock()
+	return store.SetUint64([]byte(name), next)
+}
+
+func (r *Replicator) reportLag(ctx context.Context, name string, lag uint64) {
+	r.mu.Lock()
+	r.lags[name] = lag
+	r.mu.Unlock()
+	stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(replicatorPeer, name)},
+		replicatorLag.M(int64(lag)),
+	)
+}
 
+// Leave stops replicating from the named server and waits for it to stop.
+func (r *Replicator) Leave(name string) error {
+	r.mu.Lock()
 	r.init()
-	if _, ok := r.servers[name]; !ok {
+	rep, ok := r.servers[name]
+	if !ok {
+		r.mu.Unlock()
 		return nil
 	}
-	close(r.servers[name])
+	close(rep.leave)
 	delete(r.servers, name)
+	r.mu.Unlock()
+
+	<-rep.done
 	return nil
 }
 
+// Close stops replicating from every server and waits for them to stop.
 func (r *Replicator) Close() error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	r.init()
 
 	if r.closed {
+		r.mu.Unlock()
 		return nil
 	}
 	r.closed = true
 	close(r.close)
+	servers := r.servers
+	r.servers = make(map[string]*replica)
+	r.mu.Unlock()
+
+	for _, rep := range servers {
+		<-rep.done
+	}
 	return nil
 }
 
@@ -127,16 +401,39 @@ func (r *Replicator) init() {
 		r.logger = zap.L().Named("replicator")
 	}
 	if r.servers == nil {
-		r.servers = make(map[string]chan struct{})
+		r.servers = make(map[string]*replica)
+	}
+	if r.offsets == nil {
+		r.offsets = make(map[string]uint64)
+	}
+	if r.lags == nil {
+		r.lags = make(map[string]uint64)
 	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+	if r.BatchSize == 0 {
+		r.BatchSize = defaultReplicatorBatchSize
+	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 30 * time.Second
+	}
+	if r.LagInterval == 0 {
+		r.LagInterval = 10 * time.Second
+	}
 }
 
-func (r *Replicator) logError(err error, msg, addr string) {
+func (r *Replicator) logError(err error, msg, name, addr string) {
+	stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(replicatorPeer, name)},
+		replicatorErrors.M(1),
+	)
 	r.logger.Error(
 		msg,
+		zap.String("name", name),
 		zap.String("addr", addr),
 		zap.Error(err),
 	)
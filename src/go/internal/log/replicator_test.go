@@ -0,0 +1,173 @@
+package log_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/log"
+)
+
+func TestReplicator(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newLog := func(name string) *log.Log {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		l, err := log.NewLog(filepath.Join(dir, name), log.Config{})
+		require.NoError(t, err)
+		return l
+	}
+	source, local := newLog("source"), newLog("local")
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	cc, err := grpc.Dial(serve(t, local), opts...)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	r := &log.Replicator{
+		Dialoptions: opts,
+		LocalServer: api_gen.NewLogClient(cc),
+		BatchSize:   2,
+		MinBackoff:  10 * time.Millisecond,
+		MaxBackoff:  100 * time.Millisecond,
+		LagInterval: 10 * time.Millisecond,
+	}
+	defer r.Close()
+
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := source.Append(&api_gen.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	requireReplicated := func(n uint64) {
+		require.Eventually(t, func() bool {
+			return r.Offset("source") == n
+		}, 3*time.Second, 10*time.Millisecond)
+		for off := uint64(0); off < n; off++ {
+			record, err := local.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), record.Value)
+		}
+		_, err := local.Read(n)
+		require.Error(t, err)
+	}
+
+	// the replicator retries until the server is up
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, r.Join("source", ln.Addr().String()))
+	produce(5)
+	time.Sleep(50 * time.Millisecond)
+	serveOn(t, ln, source)
+	requireReplicated(5)
+	require.Eventually(t, func() bool {
+		return r.Lag("source") == 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// leaving stops replicating and joining again resumes
+	require.NoError(t, r.Leave("source"))
+	produce(2)
+	time.Sleep(50 * time.Millisecond)
+	requireReplicated(5)
+	require.NoError(t, r.Join("source", ln.Addr().String()))
+	requireReplicated(7)
+
+	require.NoError(t, r.Close())
+}
+
+func TestReplicatorResumes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "replicator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "source"), 0755))
+	source, err := log.NewLog(filepath.Join(dir, "source"), log.Config{})
+	require.NoError(t, err)
+	sourceAddr := serve(t, source)
+
+	// the distributed log deduplicates the replicator's records
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+	require.NoError(t, err)
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID("0")
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	local, err := log.NewDistributedLog(filepath.Join(dir, "local"), config)
+	require.NoError(t, err)
+	defer local.Close()
+	require.NoError(t, local.WaitForLeader(3*time.Second))
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	cc, err := grpc.Dial(serve(t, local), opts...)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := source.Append(&api_gen.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	startReplicator := func() *log.Replicator {
+		r := &log.Replicator{
+			Dialoptions:  opts,
+			LocalServer:  api_gen.NewLogClient(cc),
+			OffsetsFile:  filepath.Join(dir, "offsets"),
+			LastSequence: local.LastSequence,
+			BatchSize:    8,
+			MinBackoff:   time.Second,
+			MaxBackoff:   time.Second,
+			LagInterval:  10 * time.Millisecond,
+		}
+		require.NoError(t, r.Join("source", sourceAddr))
+		return r
+	}
+	requireReplicated := func(r *log.Replicator, n uint64) {
+		require.Eventually(t, func() bool {
+			return r.Offset("source") == n
+		}, 3*time.Second, 10*time.Millisecond)
+		require.Equal(t, n, local.HighWatermark())
+	}
+
+	produce(40)
+	r := startReplicator()
+	requireReplicated(r, 40)
+	require.NoError(t, r.Close())
+
+	// a restarted replicator resumes from its saved offset
+	r = startReplicator()
+	require.Equal(t, uint64(40), r.Offset("source"))
+	produce(1)
+	requireReplicated(r, 41)
+	require.NoError(t, r.Close())
+
+	// without its saved offsets it resumes after the last record the local
+	// server appended from the source, rather than replaying records too old
+	// to deduplicate
+	require.NoError(t, os.Remove(filepath.Join(dir, "offsets")))
+	r = startReplicator()
+	produce(1)
+	requireReplicated(r, 42)
+	require.NoError(t, r.Close())
+}
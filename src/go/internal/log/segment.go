@@ -15,6 +15,7 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	sum                    segmentChecksum
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -93,6 +94,47 @@ func (s *segment) Read(off uint64) (*api_gen.Record, error) {
 	return record, err
 }
 
+// reindex rebuilds the index from the records in the store, for store files
+// installed from a snapshot.
+func (s *segment) reindex() error {
+	size := make([]byte, lenWidth)
+	for pos := uint64(0); pos < s.store.size; {
+		if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		if err := s.index.Write(
+			uint32(s.nextOffset-s.baseOffset),
+			pos,
+		); err != nil {
+			return err
+		}
+		s.nextOffset++
+		pos += lenWidth + enc.Uint64(size)
+	}
+	return nil
+}
+
+// truncate removes every record at or after off from the segment.
+func (s *segment) truncate(off uint64) error {
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	if off >= s.nextOffset {
+		return nil
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err = s.store.truncate(pos); err != nil {
+		return err
+	}
+	s.index.size = (off - s.baseOffset) * entWidth
+	s.nextOffset = off
+	s.sum.reset()
+	return nil
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
 }
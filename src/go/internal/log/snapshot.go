@@ -0,0 +1,426 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// A snapshot holds the producers' recent sequences, the open and aborted
+// transactions, the registered schemas, the subjects' schema compatibilities
+// and the ACL policy, followed by the
+// log's segments, each described by its base offset, next offset, size and
+// checksum and followed by its store file. Snapshots are self-contained, but
+// restoring keeps the segments the node already holds instead of rewriting
+// them, and the others are installed as files rather than replayed record by
+// record.
+
+type segmentManifest struct {
+	BaseOffset uint64
+	NextOffset uint64
+	Size       uint64
+	Checksum   [sha256.Size]byte
+}
+
+type segmentSnapshot struct {
+	segment    *segment
+	nextOffset uint64
+	size       uint64
+}
+
+// snapshotSegments captures the bounds of every segment. Sealed segments never
+// change and the active segment is append-only, so the captured bounds stay
+// valid while the snapshot is persisted.
+func (l *Log) snapshotSegments() []segmentSnapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	segments := make([]segmentSnapshot, len(l.segments))
+	for i, s := range l.segments {
+		segments[i] = segmentSnapshot{
+			segment:    s,
+			nextOffset: s.nextOffset,
+			size:       s.store.size,
+		}
+	}
+	return segments
+}
+
+// writeSchemas writes the schemas' count followed by each length prefixed.
+func writeSchemas(w io.Writer, schemas []*api_gen.Schema) error {
+	if err := binary.Write(w, enc, uint64(len(schemas))); err != nil {
+		return err
+	}
+	for _, s := range schemas {
+		if err := writeMessage(w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSchemas(r io.Reader) ([]*api_gen.Schema, error) {
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return nil, err
+	}
+	schemas := make([]*api_gen.Schema, 0, n)
+	for i := uint64(0); i < n; i++ {
+		s := &api_gen.Schema{}
+		if err := readMessage(r, s); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// writeCompatibilities writes the subjects' compatibilities as writeSchemas
+// writes schemas.
+func writeCompatibilities(
+	w io.Writer,
+	compat []*api_gen.SetSchemaCompatibilityRequest,
+) error {
+	if err := binary.Write(w, enc, uint64(len(compat))); err != nil {
+		return err
+	}
+	for _, c := range compat {
+		if err := writeMessage(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCompatibilities(r io.Reader) ([]*api_gen.SetSchemaCompatibilityRequest, error) {
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return nil, err
+	}
+	compat := make([]*api_gen.SetSchemaCompatibilityRequest, 0, n)
+	for i := uint64(0); i < n; i++ {
+		c := &api_gen.SetSchemaCompatibilityRequest{}
+		if err := readMessage(r, c); err != nil {
+			return nil, err
+		}
+		compat = append(compat, c)
+	}
+	return compat, nil
+}
+
+// writeMessage writes the message length prefixed.
+func writeMessage(w io.Writer, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = binary.Write(w, enc, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readMessage(r io.Reader, m proto.Message) error {
+	var size uint64
+	if err := binary.Read(r, enc, &size); err != nil {
+		return err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, m)
+}
+
+func writeSegments(w io.Writer, segments []segmentSnapshot) error {
+	if err := binary.Write(w, enc, uint64(len(segments))); err != nil {
+		return err
+	}
+	for _, s := range segments {
+		sum, err := s.segment.checksum(s.size)
+		if err != nil {
+			return err
+		}
+		m := segmentManifest{
+			BaseOffset: s.segment.baseOffset,
+			NextOffset: s.nextOffset,
+			Size:       s.size,
+		}
+		copy(m.Checksum[:], sum)
+		if err := binary.Write(w, enc, &m); err != nil {
+			return err
+		}
+		r := io.NewSectionReader(s.segment.store, 0, int64(s.size))
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore replaces the log's segments with those in the snapshot read from
+// r. Segments the log holds are kept and the rest are installed in a staging
+// directory, so a snapshot that fails to restore leaves the log as it was.
+// The staged segments are only moved into the log once every one has been
+// installed.
+func (l *Log) restore(r io.Reader) error {
+	// staged in a sibling directory since setup loads every file in Dir
+	staging := l.Dir + ".restore"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	kept, staged, err := l.stage(r, staging)
+	if err != nil {
+		for _, s := range staged {
+			s.Close()
+		}
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.swap(kept, staged)
+}
+
+// stage reads the snapshot's segments, finding those the log holds and
+// installing the others in the staging directory.
+func (l *Log) stage(
+	r io.Reader,
+	staging string,
+) (kept map[*segment]segmentManifest, staged []*segment, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	local := make(map[uint64]*segment, len(l.segments))
+	for _, s := range l.segments {
+		local[s.baseOffset] = s
+	}
+	var count uint64
+	if err := binary.Read(r, enc, &count); err != nil {
+		return nil, nil, err
+	}
+	kept = make(map[*segment]segmentManifest)
+	for i := uint64(0); i < count; i++ {
+		var m segmentManifest
+		if err := binary.Read(r, enc, &m); err != nil {
+			return nil, staged, err
+		}
+		if s, ok := local[m.BaseOffset]; ok {
+			held, err := s.holds(m)
+			if err != nil {
+				return nil, staged, err
+			}
+			if held {
+				if _, err := io.CopyN(io.Discard, r, int64(m.Size)); err != nil {
+					return nil, staged, err
+				}
+				kept[s] = m
+				continue
+			}
+		}
+		s, err := installSegment(staging, m, r, l.Config)
+		if err != nil {
+			return nil, staged, err
+		}
+		staged = append(staged, s)
+	}
+	return kept, staged, nil
+}
+
+// swap removes the segments that weren't kept, truncates the kept ones to
+// the snapshot and moves the staged ones into the log. Whatever happens the
+// log is left with the segments that are still open.
+func (l *Log) swap(
+	kept map[*segment]segmentManifest,
+	staged []*segment,
+) (err error) {
+	open := make(map[uint64]*segment, len(l.segments)+len(staged))
+	defer func() {
+		for _, s := range staged {
+			s.Close()
+		}
+		l.lastAppend = nil
+		l.segments = l.segments[:0]
+		for _, s := range open {
+			l.segments = append(l.segments, s)
+		}
+		sort.Slice(l.segments, func(i, j int) bool {
+			return l.segments[i].baseOffset < l.segments[j].baseOffset
+		})
+		if err != nil {
+			return
+		}
+		if len(l.segments) == 0 {
+			err = l.newSegment(l.Config.Segment.InitialOffset)
+			return
+		}
+		l.activeSegment = l.segments[len(l.segments)-1]
+		if l.activeSegment.IsMaxed() {
+			err = l.newSegment(l.activeSegment.nextOffset)
+		}
+	}()
+
+	for _, s := range l.segments {
+		open[s.baseOffset] = s
+	}
+	for _, s := range l.segments {
+		if _, ok := kept[s]; !ok {
+			delete(open, s.baseOffset)
+			if err = s.Remove(); err != nil {
+				return err
+			}
+		}
+	}
+	for s, m := range kept {
+		if err = s.truncate(m.NextOffset); err != nil {
+			return err
+		}
+	}
+	for len(staged) > 0 {
+		s := staged[0]
+		staged = staged[1:]
+		if err = s.Close(); err != nil {
+			return err
+		}
+		for _, name := range []string{s.store.Name(), s.index.Name()} {
+			if err = os.Rename(
+				name,
+				path.Join(l.Dir, path.Base(name)),
+			); err != nil {
+				return err
+			}
+		}
+		if s, err = newSegment(l.Dir, s.baseOffset, l.Config); err != nil {
+			return err
+		}
+		open[s.baseOffset] = s
+	}
+	return nil
+}
+
+// installSegment writes the segment m describes, read from r, into dir and
+// indexes it.
+func installSegment(
+	dir string,
+	m segmentManifest,
+	r io.Reader,
+	c Config,
+) (*segment, error) {
+	f, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d.store", m.BaseOffset)),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err = io.CopyN(io.MultiWriter(f, h), r, int64(m.Size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), m.Checksum[:]) {
+		return nil, fmt.Errorf(
+			"snapshot segment %d failed checksum",
+			m.BaseOffset,
+		)
+	}
+
+	s, err := newSegment(dir, m.BaseOffset, c)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.reindex(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.nextOffset != m.NextOffset {
+		s.Close()
+		return nil, fmt.Errorf(
+			"snapshot segment %d has next offset %d, want %d",
+			m.BaseOffset,
+			s.nextOffset,
+			m.NextOffset,
+		)
+	}
+	return s, nil
+}
+
+// segmentChecksum caches a segment's checksum. Sealed segments are summed once;
+// the active segment is re-summed whenever it has grown.
+type segmentChecksum struct {
+	mu   sync.Mutex
+	size uint64
+	sum  []byte
+}
+
+func (s *segment) checksum(size uint64) ([]byte, error) {
+	s.sum.mu.Lock()
+	defer s.sum.mu.Unlock()
+
+	if s.sum.sum != nil && s.sum.size == size {
+		return s.sum.sum, nil
+	}
+	h := sha256.New()
+	r := io.NewSectionReader(s.store, 0, int64(size))
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	s.sum.size = size
+	s.sum.sum = h.Sum(nil)
+	return s.sum.sum, nil
+}
+
+func (c *segmentChecksum) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = 0
+	c.sum = nil
+}
+
+// holds reports whether the segment starts with the records m describes. It
+// may hold more records after them.
+func (s *segment) holds(m segmentManifest) (bool, error) {
+	if s.baseOffset != m.BaseOffset || s.nextOffset < m.NextOffset {
+		return false, nil
+	}
+	size := s.store.size
+	if s.nextOffset > m.NextOffset {
+		_, pos, err := s.index.Read(int64(m.NextOffset - s.baseOffset))
+		if err != nil {
+			return false, err
+		}
+		size = pos
+	}
+	if size != m.Size {
+		return false, nil
+	}
+	sum, err := s.checksum(m.Size)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sum, m.Checksum[:]), nil
+}
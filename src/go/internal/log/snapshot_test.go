@@ -0,0 +1,126 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+
+	newLog := func() *Log {
+		dir, err := os.MkdirTemp("", "snapshot-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		return l
+	}
+
+	src := newLog()
+	for i := 0; i < 4; i++ {
+		_, err := src.Append(&api_gen.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	srcFSM := newFSM(src)
+	_, err := srcFSM.schemas.Register(&api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Definition: `{"type": "string"}`,
+	})
+	require.NoError(t, err)
+	compat := []*api_gen.SetSchemaCompatibilityRequest{{
+		Subject:       "user",
+		Compatibility: api_gen.Compatibility_COMPATIBILITY_FULL,
+	}}
+	require.NoError(t, srcFSM.schemas.SetCompatibility(compat[0]))
+	srcFSM.policy.update([][]string{{"p", "root", "log", "produce"}}, nil)
+	snap := persistSnapshot(t, srcFSM)
+
+	// an empty node installs every segment, the schemas and the policy
+	dst := newLog()
+	dstFSM := newFSM(dst)
+	require.NoError(t, dstFSM.Restore(snap.reader()))
+	requireRecords(t, dst, 4)
+	schema, err := dstFSM.schemas.Get("user", 1)
+	require.NoError(t, err)
+	require.Equal(t, `{"type": "string"}`, schema.Definition)
+	require.Equal(t, compat, dstFSM.schemas.Compatibilities())
+	require.Equal(t, [][]string{{"p", "root", "log", "produce"}}, dstFSM.policy.list())
+	// bootstrapping doesn't undo the policy's updates
+	dstFSM.policy.bootstrap([][]string{{"p", "nobody", "log", "produce"}})
+	require.Equal(t, [][]string{{"p", "root", "log", "produce"}}, dstFSM.policy.list())
+
+	// a node holding some of the segments keeps them and drops stale ones
+	_, err = dst.Append(&api_gen.Record{Value: []byte("diverged")})
+	require.NoError(t, err)
+	kept := dst.segments[0]
+	require.NoError(t, newFSM(dst).Restore(snap.reader()))
+	require.Same(t, kept, dst.segments[0])
+	requireRecords(t, dst, 4)
+
+	// the restored log keeps appending where the snapshot ended
+	off, err := dst.Append(&api_gen.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// a corrupt segment is rejected, leaving the log as it was
+	b := snap.Bytes()
+	b[len(b)-1] ^= 0xff
+	corrupt := newLog()
+	_, err = corrupt.Append(&api_gen.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Error(t, newFSM(corrupt).Restore(snap.reader()))
+	requireRecords(t, corrupt, 1)
+	off, err = corrupt.Append(&api_gen.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = os.Stat(corrupt.Dir + ".restore")
+	require.True(t, os.IsNotExist(err))
+}
+
+func persistSnapshot(t *testing.T, f *fsm) *testSink {
+	t.Helper()
+	s, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &testSink{}
+	require.NoError(t, s.Persist(sink))
+	return sink
+}
+
+func requireRecords(t *testing.T, l *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		got, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+	_, err := l.Read(uint64(n))
+	require.Error(t, err)
+}
+
+var _ raft.SnapshotSink = (*testSink)(nil)
+
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) reader() *readCloser {
+	return &readCloser{bytes.NewReader(s.Bytes())}
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
+
+type readCloser struct {
+	*bytes.Reader
+}
+
+func (r *readCloser) Close() error { return nil }
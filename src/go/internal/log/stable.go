@@ -0,0 +1,276 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+)
+
+// errKeyNotFound is returned for keys missing from the stable store. Raft
+// matches on the error's text to tell an empty store from a failed one.
+var errKeyNotFound = errors.New("not found")
+
+var _ raft.StableStore = (*stableStore)(nil)
+
+// stableStore holds Raft's current term and vote. The keys are few and
+// rarely written, so the whole store is rewritten on every change: encoded
+// to a temporary file, fsynced, and renamed over the previous copy.
+type stableStore struct {
+	mu   sync.Mutex
+	path string
+	kv   map[string][]byte
+}
+
+// boltMagic is the magic number in a BoltDB file's meta page, after the page
+// header.
+const (
+	boltMagic       uint32 = 0xED0CDAED
+	boltMagicOffset        = 16
+)
+
+// boltConfBucket is the bucket raft-boltdb kept the term and vote in.
+var boltConfBucket = []byte("conf")
+
+// importBoltStore imports the term and vote from the BoltDB database at path,
+// the stable store before this one replaced it, then renames the database
+// aside so it's only imported once. Starting without them could let the node
+// vote twice in a term.
+func importBoltStore(path string, s *stableStore) error {
+	ok, err := isBoltStore(path)
+	if err != nil || !ok {
+		return err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		ReadOnly: true,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("open BoltDB stable store %s: %w", path, err)
+	}
+	kv := make(map[string][]byte)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltConfBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			kv[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("read BoltDB stable store %s: %w", path, err)
+	}
+	if err = s.setAll(kv); err != nil {
+		return err
+	}
+	if err = os.Rename(path, path+".imported"); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// isBoltStore reports whether the file is a BoltDB database.
+func isBoltStore(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, boltMagicOffset+4)
+	if _, err = io.ReadFull(f, b); err != nil {
+		return false, nil
+	}
+	// BoltDB writes its pages in the host's byte order
+	magic := b[boltMagicOffset:]
+	return binary.LittleEndian.Uint32(magic) == boltMagic ||
+		binary.BigEndian.Uint32(magic) == boltMagic, nil
+}
+
+func newStableStore(path string) (*stableStore, error) {
+	s := &stableStore{
+		path: path,
+		kv:   make(map[string][]byte),
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = s.decode(b); err != nil {
+		return nil, fmt.Errorf("stable store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *stableStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.kv[string(key)]
+	s.kv[string(key)] = append([]byte(nil), val...)
+	if err := s.persist(); err != nil {
+		if ok {
+			s.kv[string(key)] = prev
+		} else {
+			delete(s.kv, string(key))
+		}
+		return err
+	}
+	return nil
+}
+
+// setAll sets every key at once.
+func (s *stableStore) setAll(kv map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.kv
+	s.kv = make(map[string][]byte, len(prev)+len(kv))
+	for k, v := range prev {
+		s.kv[k] = v
+	}
+	for k, v := range kv {
+		s.kv[k] = v
+	}
+	if err := s.persist(); err != nil {
+		s.kv = prev
+		return err
+	}
+	return nil
+}
+
+func (s *stableStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.kv[string(key)]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (s *stableStore) SetUint64(key []byte, val uint64) error {
+	b := make([]byte, 8)
+	enc.PutUint64(b, val)
+	return s.Set(key, b)
+}
+
+func (s *stableStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("stable store value for %q is not a uint64", key)
+	}
+	return enc.Uint64(b), nil
+}
+
+func (s *stableStore) persist() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(s.encode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir syncs the directory so the files renamed into it stay renamed.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// encode writes each key and value with a length prefix, like the store does
+// for records, followed by a CRC of everything before it.
+func (s *stableStore) encode() []byte {
+	keys := make([]string, 0, len(s.kv))
+	for k := range s.kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		_ = binary.Write(&buf, enc, uint64(len(k)))
+		buf.WriteString(k)
+		_ = binary.Write(&buf, enc, uint64(len(s.kv[k])))
+		buf.Write(s.kv[k])
+	}
+	_ = binary.Write(&buf, enc, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func (s *stableStore) decode(b []byte) error {
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	body, sum := b[:len(b)-4], enc.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return errors.New("checksum mismatch")
+	}
+	r := bytes.NewReader(body)
+	next := func() ([]byte, error) {
+		var n uint64
+		if err := binary.Read(r, enc, &n); err != nil {
+			return nil, err
+		}
+		if n > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		p := make([]byte, n)
+		_, err := io.ReadFull(r, p)
+		return p, err
+	}
+	for r.Len() > 0 {
+		k, err := next()
+		if err != nil {
+			return err
+		}
+		v, err := next()
+		if err != nil {
+			return err
+		}
+		s.kv[string(k)] = v
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStableStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stable-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stable")
+
+	s, err := newStableStore(path)
+	require.NoError(t, err)
+
+	_, err = s.Get([]byte("LastVoteCand"))
+	require.Equal(t, errKeyNotFound, err)
+	_, err = s.GetUint64([]byte("CurrentTerm"))
+	require.Equal(t, errKeyNotFound, err)
+
+	require.NoError(t, s.Set([]byte("LastVoteCand"), []byte("node-1")))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 3))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 4))
+
+	s, err = newStableStore(path)
+	require.NoError(t, err)
+	val, err := s.Get([]byte("LastVoteCand"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node-1"), val)
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), term)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	_, err = newStableStore(path)
+	require.Error(t, err)
+}
+
+func TestImportBoltStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stable-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stable")
+	s, err := newStableStore(filepath.Join(dir, "stable.dat"))
+	require.NoError(t, err)
+
+	// there's nothing to import without a BoltDB store
+	require.NoError(t, importBoltStore(path, s))
+	_, err = s.GetUint64([]byte("CurrentTerm"))
+	require.Equal(t, errKeyNotFound, err)
+
+	// this store's files aren't mistaken for BoltDB's
+	other, err := newStableStore(path)
+	require.NoError(t, err)
+	require.NoError(t, other.SetUint64([]byte("CurrentTerm"), 4))
+	bolt, err := isBoltStore(path)
+	require.NoError(t, err)
+	require.False(t, bolt)
+
+	// the term and vote are imported from a store raft-boltdb wrote, with
+	// a term of 5 and a vote for node-1
+	b, err := os.ReadFile(filepath.Join("testdata", "boltdb-stable"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+	bolt, err = isBoltStore(path)
+	require.NoError(t, err)
+	require.True(t, bolt)
+
+	require.NoError(t, importBoltStore(path, s))
+	s, err = newStableStore(filepath.Join(dir, "stable.dat"))
+	require.NoError(t, err)
+	for _, key := range []string{"CurrentTerm", "LastVoteTerm"} {
+		term, err := s.GetUint64([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), term)
+	}
+	cand, err := s.Get([]byte("LastVoteCand"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node-1"), cand)
+
+	// and the BoltDB store is renamed aside so it's imported once
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + ".imported")
+	require.NoError(t, err)
+}
@@ -0,0 +1,176 @@
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// txns tracks the transactions that are open and those that were aborted so
+// read committed consumers can skip their records. Transaction ids are the
+// Raft index of the entry that began the transaction. Open transactions map
+// to when the leader began them, so it can abort those left open too long,
+// and aborted ones to their marker's offset, after which they have
+// no records and are forgotten once the log no longer holds it.
+type txns struct {
+	mu      sync.RWMutex
+	open    map[uint64]time.Time
+	aborted map[uint64]uint64
+}
+
+func newTxns() *txns {
+	return &txns{
+		open:    make(map[uint64]time.Time),
+		aborted: make(map[uint64]uint64),
+	}
+}
+
+func (t *txns) begin(id uint64, began time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[id] = began
+}
+
+func (t *txns) isOpen(id uint64) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.open[id]
+	return ok
+}
+
+// end closes the transaction whose marker was appended at offset.
+func (t *txns) end(id uint64, commit bool, offset uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.open, id)
+	if !commit {
+		t.aborted[id] = offset
+	}
+}
+
+// expired returns the transactions that began before the time.
+func (t *txns) expired(before time.Time) []uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ids []uint64
+	for id, began := range t.open {
+		if began.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// prune forgets the aborted transactions whose markers, and so all of their
+// records, are below the lowest offset the log holds.
+func (t *txns) prune(lowest uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, offset := range t.aborted {
+		if offset < lowest {
+			delete(t.aborted, id)
+		}
+	}
+}
+
+func (t *txns) state(id uint64) (open, aborted bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, open = t.open[id]
+	_, aborted = t.aborted[id]
+	return open, aborted
+}
+
+// writeTo writes the open transactions' ids and begin times followed by the
+// aborted ones' ids and marker offsets, each prefixed with their count.
+func (t *txns) writeTo(w io.Writer) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	open := make([]uint64, 0, len(t.open))
+	for id := range t.open {
+		open = append(open, id)
+	}
+	ids := sortedIDs(open)
+	if err := binary.Write(w, enc, ids[0]); err != nil {
+		return err
+	}
+	for _, id := range ids[1:] {
+		began := uint64(t.open[id].UnixNano())
+		if err := binary.Write(w, enc, [2]uint64{id, began}); err != nil {
+			return err
+		}
+	}
+	aborted := make([]uint64, 0, len(t.aborted))
+	for id := range t.aborted {
+		aborted = append(aborted, id)
+	}
+	ids = sortedIDs(aborted)
+	if err := binary.Write(w, enc, ids[0]); err != nil {
+		return err
+	}
+	for _, id := range ids[1:] {
+		if err := binary.Write(w, enc, [2]uint64{id, t.aborted[id]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *txns) clone() *txns {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c := newTxns()
+	for id, began := range t.open {
+		c.open[id] = began
+	}
+	for id, offset := range t.aborted {
+		c.aborted[id] = offset
+	}
+	return c
+}
+
+// readTxns reads the transactions writeTo wrote.
+func readTxns(r io.Reader) (*txns, error) {
+	t := newTxns()
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return nil, err
+	}
+	open := make([][2]uint64, n)
+	if err := binary.Read(r, enc, open); err != nil {
+		return nil, err
+	}
+	for _, o := range open {
+		t.open[o[0]] = time.Unix(0, int64(o[1]))
+	}
+	if err := binary.Read(r, enc, &n); err != nil {
+		return nil, err
+	}
+	aborted := make([][2]uint64, n)
+	if err := binary.Read(r, enc, aborted); err != nil {
+		return nil, err
+	}
+	for _, a := range aborted {
+		t.aborted[a[0]] = a[1]
+	}
+	return t, nil
+}
+
+// replace swaps in the transactions restored from a snapshot.
+func (t *txns) replace(o *txns) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open, t.aborted = o.open, o.aborted
+}
+
+// sortedIDs returns the ids sorted and prefixed with their count.
+func sortedIDs(ids []uint64) []uint64 {
+	sorted := make([]uint64, 0, len(ids)+1)
+	sorted = append(sorted, uint64(len(ids)))
+	sorted = append(sorted, ids...)
+	sort.Slice(sorted[1:], func(i, j int) bool { return sorted[i+1] < sorted[j+1] })
+	return sorted
+}
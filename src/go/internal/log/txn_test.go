@@ -0,0 +1,111 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+func TestTxn(t *testing.T) {
+	dir, err := os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	f := newFSM(l)
+
+	var index uint64
+	apply := func(reqType RequestType, req proto.Message) interface{} {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		index++
+		return f.Apply(&raft.Log{
+			Index: index,
+			Data:  append([]byte{byte(reqType)}, b...),
+		})
+	}
+	began := time.Now().Add(-time.Hour)
+	begin := func() uint64 {
+		res := apply(BeginTxnRequestType, &api_gen.BeginTxnRequest{
+			BeginTime: timestamppb.New(began),
+		})
+		return res.(*api_gen.BeginTxnResponse).TxnId
+	}
+	produce := func(id uint64) interface{} {
+		return apply(AppendRequestType, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{Value: []byte("hello world"), TxnId: id},
+		})
+	}
+	end := func(id uint64, marker api_gen.TxnMarker) interface{} {
+		return apply(EndTxnRequestType, &api_gen.Record{TxnId: id, Marker: marker})
+	}
+
+	committed, aborted := begin(), begin()
+	require.NotEqual(t, committed, aborted)
+	require.IsType(t, &api_gen.ProduceResponse{}, produce(committed))
+	require.IsType(t, &api_gen.ProduceResponse{}, produce(aborted))
+
+	open, wasAborted := f.txns.state(committed)
+	require.True(t, open)
+	require.False(t, wasAborted)
+
+	res := end(committed, api_gen.TxnMarker_TXN_MARKER_COMMIT)
+	marker, err := l.Read(res.(*api_gen.EndTxnResponse).Offset)
+	require.NoError(t, err)
+	require.Equal(t, api_gen.TxnMarker_TXN_MARKER_COMMIT, marker.Marker)
+	require.Equal(t, committed, marker.TxnId)
+	end(aborted, api_gen.TxnMarker_TXN_MARKER_ABORT)
+
+	open, wasAborted = f.txns.state(committed)
+	require.False(t, open)
+	require.False(t, wasAborted)
+	open, wasAborted = f.txns.state(aborted)
+	require.False(t, open)
+	require.True(t, wasAborted)
+
+	// ended transactions can't be produced to or ended again
+	require.Equal(t, api.ErrTxnNotOpen{TxnID: committed}, produce(committed))
+	require.Equal(
+		t,
+		api.ErrTxnNotOpen{TxnID: aborted},
+		end(aborted, api_gen.TxnMarker_TXN_MARKER_COMMIT),
+	)
+
+	// transactions are snapshotted with the log
+	pending := begin()
+	snap := persistSnapshot(t, f)
+	dir, err = os.MkdirTemp("", "txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	restored := newFSM(l)
+	require.NoError(t, restored.Restore(snap.reader()))
+	open, _ = restored.txns.state(pending)
+	require.True(t, open)
+	// timed from when the leader began them, not when they were applied or
+	// restored
+	require.Empty(t, restored.txns.expired(began))
+	require.Equal(t, []uint64{pending}, restored.txns.expired(began.Add(time.Millisecond)))
+	_, wasAborted = restored.txns.state(aborted)
+	require.True(t, wasAborted)
+
+	// aborted transactions are forgotten once the log no longer holds their
+	// marker
+	restored.txns.prune(res.(*api_gen.EndTxnResponse).Offset + 1)
+	_, wasAborted = restored.txns.state(aborted)
+	require.True(t, wasAborted)
+	restored.txns.prune(res.(*api_gen.EndTxnResponse).Offset + 3)
+	_, wasAborted = restored.txns.state(aborted)
+	require.False(t, wasAborted)
+	open, _ = restored.txns.state(pending)
+	require.True(t, open)
+}
@@ -0,0 +1,271 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Quota bounds a subject's throughput. Zero is unlimited.
+type Quota struct {
+	ProduceRecordsPerSecond float64 `json:"produce_records_per_second"`
+	ProduceBytesPerSecond   float64 `json:"produce_bytes_per_second"`
+	ConsumeRecordsPerSecond float64 `json:"consume_records_per_second"`
+	ConsumeBytesPerSecond   float64 `json:"consume_bytes_per_second"`
+	// Streams bounds how many streams the subject can have open at once.
+	Streams int `json:"streams"`
+}
+
+// Config holds the default quota and the quotas of subjects that override it.
+type Config struct {
+	Default  Quota            `json:"default"`
+	Subjects map[string]Quota `json:"subjects"`
+}
+
+func (c Config) quota(subject string) Quota {
+	if q, ok := c.Subjects[subject]; ok {
+		return q
+	}
+	return c.Default
+}
+
+// Load reads a Config from a JSON file.
+func Load(file string) (Config, error) {
+	var c Config
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// Direction is whether records are produced or consumed.
+type Direction int
+
+const (
+	Produce Direction = iota
+	Consume
+)
+
+// Manager tracks each subject's usage of its quota. Rates are enforced with
+// token buckets holding a second's worth of records and bytes.
+type Manager struct {
+	mu       sync.Mutex
+	config   Config
+	subjects map[string]*usage
+	// idleTimeout is how long a subject goes unused before it's forgotten,
+	// and swept when subjects were last checked for it.
+	idleTimeout time.Duration
+	swept       time.Time
+}
+
+type usage struct {
+	records  [2]*rate.Limiter
+	bytes    [2]*rate.Limiter
+	streams  int
+	lastUsed time.Time
+}
+
+// subjectIdleTimeout is how long a subject's usage is kept after it was last
+// used, so subjects that come and go, such as clients with short-lived
+// certificates, don't accumulate.
+const subjectIdleTimeout = 10 * time.Minute
+
+func New(config Config) *Manager {
+	return &Manager{
+		config:      config,
+		subjects:    make(map[string]*usage),
+		idleTimeout: subjectIdleTimeout,
+		swept:       time.Now(),
+	}
+}
+
+// Update replaces the quotas. Subjects keep their usage, so a reload doesn't
+// reset their buckets or streams, but idle subjects are forgotten.
+func (m *Manager) Update(config Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = config
+	now := time.Now()
+	m.sweep(now)
+	for subject, u := range m.subjects {
+		u.set(now, config.quota(subject))
+	}
+}
+
+// sweep forgets subjects that have gone unused for the idle timeout, unless
+// they have streams open or their buckets haven't refilled, which forgetting
+// would reset. m.mu must be held.
+func (m *Manager) sweep(now time.Time) {
+	for subject, u := range m.subjects {
+		if u.streams == 0 && now.Sub(u.lastUsed) >= m.idleTimeout && u.full(now) {
+			delete(m.subjects, subject)
+		}
+	}
+	m.swept = now
+}
+
+func (m *Manager) usage(subject string) *usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usageLocked(subject)
+}
+
+// usageLocked returns the subject's usage, marking it used, and sweeps idle
+// subjects once an idle timeout has passed since they were last swept. m.mu
+// must be held.
+func (m *Manager) usageLocked(subject string) *usage {
+	now := time.Now()
+	if now.Sub(m.swept) >= m.idleTimeout {
+		m.sweep(now)
+	}
+	u, ok := m.subjects[subject]
+	if !ok {
+		q := m.config.quota(subject)
+		u = &usage{
+			records: [2]*rate.Limiter{
+				newLimiter(q.ProduceRecordsPerSecond),
+				newLimiter(q.ConsumeRecordsPerSecond),
+			},
+			bytes: [2]*rate.Limiter{
+				newLimiter(q.ProduceBytesPerSecond),
+				newLimiter(q.ConsumeBytesPerSecond),
+			},
+		}
+		m.subjects[subject] = u
+	}
+	u.lastUsed = now
+	return u
+}
+
+func newLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst(perSecond))
+}
+
+func burst(perSecond float64) int {
+	return int(math.Max(1, math.Ceil(perSecond)))
+}
+
+// full is whether the subject's buckets have refilled.
+func (u *usage) full(now time.Time) bool {
+	for _, l := range append(u.records[:], u.bytes[:]...) {
+		if l.Limit() != rate.Inf && l.TokensAt(now) < float64(l.Burst()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *usage) set(now time.Time, q Quota) {
+	setRate(now, u.records[Produce], q.ProduceRecordsPerSecond)
+	setRate(now, u.bytes[Produce], q.ProduceBytesPerSecond)
+	setRate(now, u.records[Consume], q.ConsumeRecordsPerSecond)
+	setRate(now, u.bytes[Consume], q.ConsumeBytesPerSecond)
+}
+
+func setRate(now time.Time, l *rate.Limiter, perSecond float64) {
+	if perSecond <= 0 {
+		l.SetLimitAt(now, rate.Inf)
+		return
+	}
+	l.SetLimitAt(now, rate.Limit(perSecond))
+	l.SetBurstAt(now, burst(perSecond))
+}
+
+// Reserve takes the records and bytes from the subject's quota if it has
+// them, and otherwise returns how long to wait before retrying. Consumers,
+// who don't know how much they'll read, reserve nothing and are charged
+// after reading.
+func (m *Manager) Reserve(subject string, d Direction, records, bytes int) time.Duration {
+	u := m.usage(subject)
+	now := time.Now()
+	var delay time.Duration
+	var reserved []*rate.Reservation
+	for _, take := range []struct {
+		l *rate.Limiter
+		n int
+	}{{u.records[d], records}, {u.bytes[d], bytes}} {
+		r := take.l.ReserveN(now, clamp(take.l, take.n))
+		reserved = append(reserved, r)
+		if wait := r.DelayFrom(now); wait > delay {
+			delay = wait
+		}
+	}
+	if delay > 0 {
+		for _, r := range reserved {
+			r.CancelAt(now)
+		}
+	}
+	return delay
+}
+
+// Charge takes the records and bytes from the subject's quota even if it's
+// exhausted, delaying its next reservations.
+func (m *Manager) Charge(subject string, d Direction, records, bytes int) {
+	u := m.usage(subject)
+	now := time.Now()
+	charge(now, u.records[d], records)
+	charge(now, u.bytes[d], bytes)
+}
+
+// charge takes n from the bucket a bucket's worth at a time, since a
+// reservation can't be larger.
+func charge(now time.Time, l *rate.Limiter, n int) {
+	for n > 0 && l.Limit() != rate.Inf {
+		take := clamp(l, n)
+		l.ReserveN(now, take)
+		n -= take
+	}
+}
+
+// Wait blocks until the subject's quota has the records and bytes, or ctx is
+// done.
+func (m *Manager) Wait(ctx context.Context, subject string, d Direction, records, bytes int) error {
+	u := m.usage(subject)
+	if err := u.records[d].WaitN(ctx, clamp(u.records[d], records)); err != nil {
+		return err
+	}
+	return u.bytes[d].WaitN(ctx, clamp(u.bytes[d], bytes))
+}
+
+// clamp limits n to the bucket's size so a record larger than a second's
+// worth of bytes takes the whole bucket rather than never fitting.
+func clamp(l *rate.Limiter, n int) int {
+	if l.Limit() == rate.Inf {
+		return 0
+	}
+	if b := l.Burst(); n > b {
+		return b
+	}
+	return n
+}
+
+// OpenStream counts a stream against the subject's quota, returning false if
+// it has as many streams open as it's allowed. Call release when the stream
+// ends.
+func (m *Manager) OpenStream(subject string) (release func(), ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usageLocked(subject)
+	if max := m.config.quota(subject).Streams; max > 0 && u.streams >= max {
+		return nil, false
+	}
+	u.streams++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			u.streams--
+		})
+	}, true
+}
@@ -0,0 +1,104 @@
+package quota
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	m := New(Config{
+		Default: Quota{ProduceRecordsPerSecond: 2, Streams: 1},
+		Subjects: map[string]Quota{
+			"root": {ConsumeBytesPerSecond: 10},
+		},
+	})
+
+	// a second's worth of records is allowed at once
+	require.Zero(t, m.Reserve("nobody", Produce, 1, 100))
+	require.Zero(t, m.Reserve("nobody", Produce, 1, 100))
+	delay := m.Reserve("nobody", Produce, 1, 100)
+	require.Greater(t, delay, time.Duration(0))
+	require.LessOrEqual(t, delay, 500*time.Millisecond)
+	// subjects have their own quotas
+	require.Zero(t, m.Reserve("root", Produce, 100, 100))
+
+	// consumers are charged after reading, delaying their next read
+	require.Zero(t, m.Reserve("root", Consume, 0, 0))
+	m.Charge("root", Consume, 1, 20)
+	require.Greater(t, m.Reserve("root", Consume, 0, 0), time.Duration(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Error(t, m.Wait(ctx, "nobody", Produce, 1, 0))
+
+	release, ok := m.OpenStream("nobody")
+	require.True(t, ok)
+	_, ok = m.OpenStream("nobody")
+	require.False(t, ok)
+
+	// updates keep open streams counted
+	m.Update(Config{Default: Quota{Streams: 2}})
+	_, ok = m.OpenStream("nobody")
+	require.True(t, ok)
+	_, ok = m.OpenStream("nobody")
+	require.False(t, ok)
+	release()
+	release()
+	_, ok = m.OpenStream("nobody")
+	require.True(t, ok)
+	require.Zero(t, m.Reserve("nobody", Produce, 100, 100))
+}
+
+func TestManagerForgetsIdleSubjects(t *testing.T) {
+	m := New(Config{Default: Quota{ProduceRecordsPerSecond: 100}})
+	m.idleTimeout = 50 * time.Millisecond
+
+	require.Zero(t, m.Reserve("idle", Produce, 1, 0))
+	require.Zero(t, m.Reserve("drained", Produce, 100, 0))
+	release, ok := m.OpenStream("streaming")
+	require.True(t, ok)
+	time.Sleep(60 * time.Millisecond)
+
+	// idle subjects are forgotten once their buckets refill, unless they
+	// have streams open
+	m.Update(Config{Default: Quota{ProduceRecordsPerSecond: 100}})
+	m.mu.Lock()
+	require.NotContains(t, m.subjects, "idle")
+	require.Contains(t, m.subjects, "drained")
+	require.Contains(t, m.subjects, "streaming")
+	m.mu.Unlock()
+
+	// and are swept as subjects are used, not just on updates
+	release()
+	m.Charge("drained", Produce, 0, 0)
+	time.Sleep(time.Second)
+	require.Zero(t, m.Reserve("active", Produce, 1, 0))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Equal(t, []string{"active"}, keys(m.subjects))
+}
+
+func keys(subjects map[string]*usage) []string {
+	var keys []string
+	for subject := range subjects {
+		keys = append(keys, subject)
+	}
+	return keys
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quotas.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{
+		"default": {"produce_records_per_second": 10},
+		"subjects": {"root": {"streams": 5}}
+	}`), 0644))
+	c, err := Load(file)
+	require.NoError(t, err)
+	require.Equal(t, 10.0, c.Default.ProduceRecordsPerSecond)
+	require.Equal(t, 5, c.Subjects["root"].Streams)
+}
@@ -0,0 +1,170 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// compatible returns an error if next, a subject's new schema, isn't
+// compatible with latest, its latest version.
+func compatible(compat api_gen.Compatibility, latest, next *compiled) error {
+	switch compat {
+	case api_gen.Compatibility_COMPATIBILITY_BACKWARD:
+		return readable(next, latest)
+	case api_gen.Compatibility_COMPATIBILITY_FORWARD:
+		return readable(latest, next)
+	case api_gen.Compatibility_COMPATIBILITY_FULL:
+		if err := readable(next, latest); err != nil {
+			return err
+		}
+		return readable(latest, next)
+	case api_gen.Compatibility_COMPATIBILITY_NONE:
+		return nil
+	}
+	return fmt.Errorf("unknown compatibility: %s", compat)
+}
+
+// readable returns an error if records written with writer's schema can't be
+// read with reader's.
+func readable(reader, writer *compiled) error {
+	if reader.typ != writer.typ {
+		return fmt.Errorf("schema type changed from %s to %s", writer.typ, reader.typ)
+	}
+	switch reader.typ {
+	case api_gen.SchemaType_SCHEMA_TYPE_JSON:
+		return jsonReadable(reader.jsonDoc, writer.jsonDoc, "#")
+	case api_gen.SchemaType_SCHEMA_TYPE_PROTOBUF:
+		return protoReadable(reader.proto, writer.proto, map[protoreflect.FullName]bool{})
+	case api_gen.SchemaType_SCHEMA_TYPE_AVRO:
+		return avro.NewSchemaCompatibility().Compatible(reader.avro, writer.avro)
+	}
+	return nil
+}
+
+// jsonReadable compares the types, required properties, properties, items
+// and enums of JSON schemas. Keywords it doesn't check can still make
+// records written with writer fail to validate against reader.
+func jsonReadable(reader, writer map[string]interface{}, path string) error {
+	if rt, ok := reader["type"]; ok {
+		allowed := jsonSet(rt)
+		wt, ok := writer["type"]
+		if !ok {
+			return fmt.Errorf("%s: type %v is new", path, rt)
+		}
+		for t := range jsonSet(wt) {
+			// integers are numbers
+			if !allowed[t] && !(t == "integer" && allowed["number"]) {
+				return fmt.Errorf("%s: type %v can't read %v", path, rt, wt)
+			}
+		}
+	}
+	if re, ok := reader["enum"].([]interface{}); ok {
+		we, ok := writer["enum"].([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: enum is new", path)
+		}
+		for _, v := range we {
+			if !jsonContains(re, v) {
+				return fmt.Errorf("%s: enum value %v was removed", path, v)
+			}
+		}
+	}
+	wreq, _ := writer["required"].([]interface{})
+	rreq, _ := reader["required"].([]interface{})
+	for _, name := range rreq {
+		if !jsonContains(wreq, name) {
+			return fmt.Errorf("%s: property %v is newly required", path, name)
+		}
+	}
+	rprops, _ := reader["properties"].(map[string]interface{})
+	wprops, _ := writer["properties"].(map[string]interface{})
+	for name, wp := range wprops {
+		rp, ok := rprops[name]
+		if !ok {
+			if reader["additionalProperties"] == false {
+				return fmt.Errorf("%s: property %s was removed", path, name)
+			}
+			continue
+		}
+		r, rok := rp.(map[string]interface{})
+		w, wok := wp.(map[string]interface{})
+		if rok && wok {
+			if err := jsonReadable(r, w, path+"/properties/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	r, rok := reader["items"].(map[string]interface{})
+	w, wok := writer["items"].(map[string]interface{})
+	if rok && wok {
+		return jsonReadable(r, w, path+"/items")
+	}
+	return nil
+}
+
+func jsonSet(v interface{}) map[interface{}]bool {
+	set := make(map[interface{}]bool)
+	if vs, ok := v.([]interface{}); ok {
+		for _, v := range vs {
+			set[v] = true
+		}
+	} else {
+		set[v] = true
+	}
+	return set
+}
+
+func jsonContains(vs []interface{}, v interface{}) bool {
+	for _, x := range vs {
+		if reflect.DeepEqual(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// protoReadable checks that fields with the same number have the same kind
+// and cardinality, recursing into message fields, so records don't decode
+// as the wrong type.
+func protoReadable(
+	reader, writer protoreflect.MessageDescriptor,
+	seen map[protoreflect.FullName]bool,
+) error {
+	if seen[reader.FullName()] {
+		return nil
+	}
+	seen[reader.FullName()] = true
+	fields := reader.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		rf := fields.Get(i)
+		wf := writer.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return fmt.Errorf("%s: required field is new", rf.FullName())
+			}
+			continue
+		}
+		if rf.Kind() != wf.Kind() || rf.Cardinality() != wf.Cardinality() {
+			return fmt.Errorf(
+				"%s: field %d changed from %s %s to %s %s",
+				rf.FullName(),
+				rf.Number(),
+				wf.Cardinality(),
+				wf.Kind(),
+				rf.Cardinality(),
+				rf.Kind(),
+			)
+		}
+		if rf.Message() != nil && wf.Message() != nil {
+			if err := protoReadable(rf.Message(), wf.Message(), seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package schema
+
+import (
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// Registry holds the versions of each subject's schema and the compatibility
+// its new versions are checked with. Registering is deterministic, so replicas
+// that register the same schemas in the same order end up with the same
+// versions.
+type Registry struct {
+	mu       sync.RWMutex
+	subjects map[string][]*version
+	// compat holds the compatibility of subjects that aren't backward
+	// compatible.
+	compat map[string]api_gen.Compatibility
+}
+
+type version struct {
+	schema   *api_gen.Schema
+	compiled *compiled
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		subjects: make(map[string][]*version),
+		compat:   make(map[string]api_gen.Compatibility),
+	}
+}
+
+// Register adds a version of the subject's schema if it's compatible with the
+// latest version, as the subject's compatibility requires, and returns its
+// number. Registering the latest version's definition again returns its
+// number.
+func (r *Registry) Register(req *api_gen.RegisterSchemaRequest) (uint32, error) {
+	if req.Subject == "" {
+		return 0, status.Error(codes.InvalidArgument, "schema subject is required")
+	}
+	c, err := compile(req.Type, req.Definition)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid schema: %s", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := r.subjects[req.Subject]
+	if n := len(versions); n > 0 {
+		latest := versions[n-1]
+		if latest.schema.Type == req.Type &&
+			latest.schema.Definition == req.Definition {
+			return latest.schema.Version, nil
+		}
+		compat := r.compat[req.Subject]
+		if err = compatible(compat, latest.compiled, c); err != nil {
+			return 0, status.Errorf(
+				codes.FailedPrecondition,
+				"schema isn't %s compatible with version %d: %s",
+				compat,
+				latest.schema.Version,
+				err,
+			)
+		}
+	}
+	v := &version{
+		schema: &api_gen.Schema{
+			Subject:    req.Subject,
+			Version:    uint32(len(versions) + 1),
+			Type:       req.Type,
+			Definition: req.Definition,
+		},
+		compiled: c,
+	}
+	r.subjects[req.Subject] = append(versions, v)
+	return v.schema.Version, nil
+}
+
+// SetCompatibility sets the compatibility the subject's new versions are
+// checked with, whether or not it has any yet.
+func (r *Registry) SetCompatibility(req *api_gen.SetSchemaCompatibilityRequest) error {
+	if req.Subject == "" {
+		return status.Error(codes.InvalidArgument, "schema subject is required")
+	}
+	if _, ok := api_gen.Compatibility_name[int32(req.Compatibility)]; !ok {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"unknown compatibility: %d",
+			req.Compatibility,
+		)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Compatibility == api_gen.Compatibility_COMPATIBILITY_BACKWARD {
+		delete(r.compat, req.Subject)
+	} else {
+		r.compat[req.Subject] = req.Compatibility
+	}
+	return nil
+}
+
+// Get returns a version of the subject's schema, or its latest for version 0.
+func (r *Registry) Get(subject string, version uint32) (*api_gen.Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, err := r.get(subject, version)
+	if err != nil {
+		return nil, err
+	}
+	return v.schema, nil
+}
+
+func (r *Registry) get(subject string, v uint32) (*version, error) {
+	versions := r.subjects[subject]
+	if len(versions) == 0 {
+		return nil, status.Errorf(codes.NotFound, "unknown schema subject: %s", subject)
+	}
+	if v == 0 {
+		return versions[len(versions)-1], nil
+	}
+	if v > uint32(len(versions)) {
+		return nil, status.Errorf(
+			codes.NotFound,
+			"unknown version %d of schema subject %s",
+			v,
+			subject,
+		)
+	}
+	return versions[v-1], nil
+}
+
+// Validate returns an InvalidArgument error unless the value is valid with
+// the version of the subject's schema, or its latest for version 0.
+func (r *Registry) Validate(subject string, version uint32, value []byte) error {
+	r.mu.RLock()
+	v, err := r.get(subject, version)
+	r.mu.RUnlock()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, status.Convert(err).Message())
+	}
+	if err = v.compiled.validate(value); err != nil {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"record doesn't match version %d of schema %s: %s",
+			v.schema.Version,
+			subject,
+			err,
+		)
+	}
+	return nil
+}
+
+// Schemas returns every version of every subject's schema, ordered by subject
+// and version.
+func (r *Registry) Schemas() []*api_gen.Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subjects := make([]string, 0, len(r.subjects))
+	for subject := range r.subjects {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	var schemas []*api_gen.Schema
+	for _, subject := range subjects {
+		for _, v := range r.subjects[subject] {
+			schemas = append(schemas, v.schema)
+		}
+	}
+	return schemas
+}
+
+// Compatibilities returns the subjects' compatibilities set by
+// SetCompatibility, ordered by subject, leaving out backward compatible ones.
+func (r *Registry) Compatibilities() []*api_gen.SetSchemaCompatibilityRequest {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subjects := make([]string, 0, len(r.compat))
+	for subject := range r.compat {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	compat := make([]*api_gen.SetSchemaCompatibilityRequest, 0, len(subjects))
+	for _, subject := range subjects {
+		compat = append(compat, &api_gen.SetSchemaCompatibilityRequest{
+			Subject:       subject,
+			Compatibility: r.compat[subject],
+		})
+	}
+	return compat
+}
+
+// Restore replaces the registry's schemas and compatibilities with those
+// returned by Schemas and Compatibilities.
+func (r *Registry) Restore(
+	schemas []*api_gen.Schema,
+	compat []*api_gen.SetSchemaCompatibilityRequest,
+) error {
+	subjects := make(map[string][]*version)
+	for _, s := range schemas {
+		c, err := compile(s.Type, s.Definition)
+		if err != nil {
+			return err
+		}
+		subjects[s.Subject] = append(subjects[s.Subject], &version{
+			schema:   s,
+			compiled: c,
+		})
+	}
+	compats := make(map[string]api_gen.Compatibility)
+	for _, c := range compat {
+		if c.Compatibility != api_gen.Compatibility_COMPATIBILITY_BACKWARD {
+			compats[c.Subject] = c.Compatibility
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subjects, r.compat = subjects, compats
+	return nil
+}
@@ -0,0 +1,262 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/hamba/avro/v2"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+func TestRegistry(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, r *Registry){
+		"json":                    testJSON,
+		"protobuf":                testProtobuf,
+		"avro":                    testAvro,
+		"versions and restore":    testVersions,
+		"invalid schema rejected": testInvalid,
+		"subject compatibility":   testCompatibility,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, NewRegistry())
+		})
+	}
+}
+
+func register(
+	t *testing.T,
+	r *Registry,
+	typ api_gen.SchemaType,
+	compat api_gen.Compatibility,
+	definition string,
+) (uint32, error) {
+	t.Helper()
+	require.NoError(t, r.SetCompatibility(&api_gen.SetSchemaCompatibilityRequest{
+		Subject:       "user",
+		Compatibility: compat,
+	}))
+	return r.Register(&api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Type:       typ,
+		Definition: definition,
+	})
+}
+
+func requireCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	require.Equal(t, code, status.Code(err), "%v", err)
+}
+
+func testJSON(t *testing.T, r *Registry) {
+	json := api_gen.SchemaType_SCHEMA_TYPE_JSON
+	backward := api_gen.Compatibility_COMPATIBILITY_BACKWARD
+	v, err := register(t, r, json, backward, `{
+		"type": "object",
+		"properties": {"name": {"type": "string"}},
+		"required": ["name"]
+	}`)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), v)
+
+	require.NoError(t, r.Validate("user", 0, []byte(`{"name": "ian"}`)))
+	requireCode(t, codes.InvalidArgument, r.Validate("user", 0, []byte(`{}`)))
+	requireCode(t, codes.InvalidArgument, r.Validate("user", 0, []byte(`not json`)))
+	requireCode(t, codes.InvalidArgument, r.Validate("group", 0, []byte(`{}`)))
+
+	// new required properties can't read old records
+	_, err = register(t, r, json, backward, `{
+		"type": "object",
+		"properties": {"name": {"type": "string"}, "age": {"type": "integer"}},
+		"required": ["name", "age"]
+	}`)
+	requireCode(t, codes.FailedPrecondition, err)
+	// changing a property's type can't either
+	_, err = register(t, r, json, backward, `{
+		"type": "object",
+		"properties": {"name": {"type": "number"}}
+	}`)
+	requireCode(t, codes.FailedPrecondition, err)
+	// but optional properties can be added
+	v, err = register(t, r, json, backward, `{
+		"type": "object",
+		"properties": {"name": {"type": "string"}, "age": {"type": "integer"}},
+		"required": ["name"]
+	}`)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), v)
+}
+
+func testProtobuf(t *testing.T, r *Registry) {
+	protobuf := api_gen.SchemaType_SCHEMA_TYPE_PROTOBUF
+	full := api_gen.Compatibility_COMPATIBILITY_FULL
+	_, err := register(t, r, protobuf, full, `
+		syntax = "proto3";
+		message User {
+			string name = 1;
+		}
+	`)
+	require.NoError(t, err)
+
+	var valid []byte
+	valid = protowire.AppendTag(valid, 1, protowire.BytesType)
+	valid = protowire.AppendString(valid, "ian")
+	require.NoError(t, r.Validate("user", 1, valid))
+	var invalid []byte
+	invalid = protowire.AppendTag(invalid, 1, protowire.VarintType)
+	invalid = protowire.AppendVarint(invalid, 1)
+	requireCode(t, codes.InvalidArgument, r.Validate("user", 1, invalid))
+
+	// reusing a field number for another type is incompatible
+	_, err = register(t, r, protobuf, full, `
+		syntax = "proto3";
+		message User {
+			int64 name = 1;
+		}
+	`)
+	requireCode(t, codes.FailedPrecondition, err)
+	_, err = register(t, r, protobuf, full, `
+		syntax = "proto3";
+		import "google/protobuf/timestamp.proto";
+		message User {
+			string name = 1;
+			google.protobuf.Timestamp created = 2;
+		}
+	`)
+	require.NoError(t, err)
+}
+
+func testAvro(t *testing.T, r *Registry) {
+	avroType := api_gen.SchemaType_SCHEMA_TYPE_AVRO
+	backward := api_gen.Compatibility_COMPATIBILITY_BACKWARD
+	definition := `{
+		"type": "record",
+		"name": "User",
+		"fields": [{"name": "name", "type": "string"}]
+	}`
+	_, err := register(t, r, avroType, backward, definition)
+	require.NoError(t, err)
+
+	value, err := avro.Marshal(
+		avro.MustParse(definition),
+		map[string]interface{}{"name": "ian"},
+	)
+	require.NoError(t, err)
+	require.NoError(t, r.Validate("user", 1, value))
+	requireCode(t, codes.InvalidArgument, r.Validate("user", 1, []byte{0x10}))
+
+	// a field without a default can't read old records
+	_, err = register(t, r, avroType, backward, `{
+		"type": "record",
+		"name": "User",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": "int"}
+		]
+	}`)
+	requireCode(t, codes.FailedPrecondition, err)
+	_, err = register(t, r, avroType, backward, `{
+		"type": "record",
+		"name": "User",
+		"fields": [
+			{"name": "name", "type": "string"},
+			{"name": "age", "type": "int", "default": 0}
+		]
+	}`)
+	require.NoError(t, err)
+}
+
+func testVersions(t *testing.T, r *Registry) {
+	json := api_gen.SchemaType_SCHEMA_TYPE_JSON
+	none := api_gen.Compatibility_COMPATIBILITY_NONE
+	for i, definition := range []string{`{"type": "string"}`, `{"type": "number"}`} {
+		v, err := register(t, r, json, none, definition)
+		require.NoError(t, err)
+		require.Equal(t, uint32(i+1), v)
+	}
+	// registering the latest again is a no-op
+	v, err := register(t, r, json, none, `{"type": "number"}`)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), v)
+
+	require.NoError(t, r.Validate("user", 1, []byte(`"ian"`)))
+	requireCode(t, codes.InvalidArgument, r.Validate("user", 0, []byte(`"ian"`)))
+	_, err = r.Get("user", 3)
+	requireCode(t, codes.NotFound, err)
+
+	restored := NewRegistry()
+	require.NoError(t, restored.Restore(r.Schemas(), r.Compatibilities()))
+	latest, err := restored.Get("user", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), latest.Version)
+	require.Equal(t, `{"type": "number"}`, latest.Definition)
+	require.Equal(t, r.Compatibilities(), restored.Compatibilities())
+	v, err = restored.Register(&api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Definition: `{"type": "boolean"}`,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), v)
+}
+
+func testCompatibility(t *testing.T, r *Registry) {
+	registerUser := func(definition string) error {
+		_, err := r.Register(&api_gen.RegisterSchemaRequest{
+			Subject:    "user",
+			Definition: definition,
+		})
+		return err
+	}
+	setCompatibility := func(subject string, compat api_gen.Compatibility) error {
+		return r.SetCompatibility(&api_gen.SetSchemaCompatibilityRequest{
+			Subject:       subject,
+			Compatibility: compat,
+		})
+	}
+
+	// subjects are backward compatible until set otherwise
+	require.NoError(t, registerUser(`{"type": "string"}`))
+	requireCode(t, codes.FailedPrecondition, registerUser(`{"type": "number"}`))
+	require.Empty(t, r.Compatibilities())
+
+	none := api_gen.Compatibility_COMPATIBILITY_NONE
+	require.NoError(t, setCompatibility("user", none))
+	require.NoError(t, registerUser(`{"type": "number"}`))
+	require.Equal(t, []*api_gen.SetSchemaCompatibilityRequest{{
+		Subject:       "user",
+		Compatibility: none,
+	}}, r.Compatibilities())
+
+	// other subjects are unaffected
+	_, err := r.Register(&api_gen.RegisterSchemaRequest{
+		Subject:    "account",
+		Definition: `{"type": "string"}`,
+	})
+	require.NoError(t, err)
+	_, err = r.Register(&api_gen.RegisterSchemaRequest{
+		Subject:    "account",
+		Definition: `{"type": "number"}`,
+	})
+	requireCode(t, codes.FailedPrecondition, err)
+
+	require.NoError(t, setCompatibility("user", api_gen.Compatibility_COMPATIBILITY_BACKWARD))
+	require.Empty(t, r.Compatibilities())
+	requireCode(t, codes.InvalidArgument, setCompatibility("", none))
+	requireCode(t, codes.InvalidArgument, setCompatibility("user", 42))
+}
+
+func testInvalid(t *testing.T, r *Registry) {
+	for typ, definition := range map[api_gen.SchemaType]string{
+		api_gen.SchemaType_SCHEMA_TYPE_JSON:     `{"type": 1}`,
+		api_gen.SchemaType_SCHEMA_TYPE_PROTOBUF: `syntax = "proto3";`,
+		api_gen.SchemaType_SCHEMA_TYPE_AVRO:     `{"type": "nope"}`,
+	} {
+		_, err := register(t, r, typ, api_gen.Compatibility_COMPATIBILITY_NONE, definition)
+		requireCode(t, codes.InvalidArgument, err)
+	}
+	_, err := r.Register(&api_gen.RegisterSchemaRequest{Definition: `{}`})
+	requireCode(t, codes.InvalidArgument, err)
+}
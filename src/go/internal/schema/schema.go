@@ -0,0 +1,153 @@
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/hamba/avro/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// compiled is a schema parsed so it can validate records and be checked for
+// compatibility with other versions.
+type compiled struct {
+	typ api_gen.SchemaType
+
+	json    *jsonschema.Schema
+	jsonDoc map[string]interface{}
+	proto   protoreflect.MessageDescriptor
+	avro    avro.Schema
+}
+
+const definitionFile = "schema"
+
+func compile(typ api_gen.SchemaType, definition string) (*compiled, error) {
+	c := &compiled{typ: typ}
+	var err error
+	switch typ {
+	case api_gen.SchemaType_SCHEMA_TYPE_JSON:
+		err = c.compileJSON(definition)
+	case api_gen.SchemaType_SCHEMA_TYPE_PROTOBUF:
+		err = c.compileProto(definition)
+	case api_gen.SchemaType_SCHEMA_TYPE_AVRO:
+		// a cache per schema so versions can redefine named types
+		c.avro, err = avro.ParseWithCache(definition, "", &avro.SchemaCache{})
+	default:
+		err = fmt.Errorf("unknown schema type: %s", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *compiled) compileJSON(definition string) error {
+	if err := json.Unmarshal([]byte(definition), &c.jsonDoc); err != nil {
+		return err
+	}
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource(definitionFile, strings.NewReader(definition))
+	if err != nil {
+		return err
+	}
+	c.json, err = compiler.Compile(definitionFile)
+	return err
+}
+
+// compileProto compiles the .proto file and uses its first message. The
+// file can import the well-known types but not other files.
+func (c *compiled) compileProto(definition string) error {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{
+				definitionFile: definition,
+			}),
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), definitionFile)
+	if err != nil {
+		return err
+	}
+	messages := files[0].Messages()
+	if messages.Len() == 0 {
+		return fmt.Errorf("no message in protobuf schema")
+	}
+	c.proto = messages.Get(0)
+	return nil
+}
+
+func (c *compiled) validate(value []byte) error {
+	switch c.typ {
+	case api_gen.SchemaType_SCHEMA_TYPE_JSON:
+		d := json.NewDecoder(bytes.NewReader(value))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		if d.More() {
+			return fmt.Errorf("more than one JSON value")
+		}
+		return c.json.Validate(v)
+	case api_gen.SchemaType_SCHEMA_TYPE_PROTOBUF:
+		m := dynamicpb.NewMessage(c.proto)
+		if err := proto.Unmarshal(value, m); err != nil {
+			return err
+		}
+		return noUnknownFields(m)
+	case api_gen.SchemaType_SCHEMA_TYPE_AVRO:
+		src := bytes.NewReader(value)
+		// a one byte buffer leaves any bytes after the record unread
+		r := avro.NewReader(src, 1)
+		var v interface{}
+		r.ReadVal(c.avro, &v)
+		if r.Error != nil {
+			return r.Error
+		}
+		if src.Len() > 0 {
+			return fmt.Errorf("%d bytes after the record", src.Len())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown schema type: %s", c.typ)
+}
+
+// noUnknownFields returns an error if the message has fields its schema
+// doesn't declare, or declares with another wire type, which Unmarshal keeps
+// as unknown fields rather than failing.
+func noUnknownFields(m protoreflect.Message) error {
+	if len(m.GetUnknown()) > 0 {
+		return fmt.Errorf("%s has undeclared fields", m.Descriptor().FullName())
+	}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				err = noUnknownFields(v.Message())
+				return err == nil
+			})
+		case fd.Message() == nil:
+		case fd.IsList():
+			for i := 0; i < v.List().Len() && err == nil; i++ {
+				err = noUnknownFields(v.List().Get(i).Message())
+			}
+		default:
+			err = noUnknownFields(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
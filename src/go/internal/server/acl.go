@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// ACLReloader is implemented by authorizers that can reread their policy.
+type ACLReloader interface {
+	Reload() (added, removed []string, err error)
+}
+
+// PolicyUpdater is implemented by authorizers whose policy can be read and
+// changed rule by rule. Each rule is its type followed by its values.
+type PolicyUpdater interface {
+	Policy() [][]string
+	UpdatePolicy(add, remove [][]string) error
+}
+
+func (s *grpcServer) ReloadACL(ctx context.Context, req *api_gen.ReloadACLRequest) (*api_gen.ReloadACLResponse, error) {
+	if err := s.authorize(ctx, objectACL, adminAction); err != nil {
+		return nil, err
+	}
+	reloader, ok := s.Authorizer.(ACLReloader)
+	if !ok {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"authorizer can't reload its policy",
+		)
+	}
+	added, removed, err := reloader.Reload()
+	s.auditAdmin(ctx, objectACL, map[string]string{
+		"operation": "reload",
+		"added":     strings.Join(added, "; "),
+		"removed":   strings.Join(removed, "; "),
+	}, err)
+	if err != nil {
+		// the previous policy is still enforced
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"failed to reload ACL policy: %s",
+			err,
+		)
+	}
+	return &api_gen.ReloadACLResponse{Added: added, Removed: removed}, nil
+}
+
+func (s *grpcServer) UpdatePolicy(ctx context.Context, req *api_gen.UpdatePolicyRequest) (*api_gen.UpdatePolicyResponse, error) {
+	if err := s.authorize(ctx, objectACL, adminAction); err != nil {
+		return nil, err
+	}
+	updater, err := s.policyUpdater()
+	if err != nil {
+		return nil, err
+	}
+	add, remove := policyRules(req.Add), policyRules(req.Remove)
+	err = updater.UpdatePolicy(add, remove)
+	s.auditAdmin(ctx, objectACL, map[string]string{
+		"operation": "update",
+		"added":     ruleStrings(add),
+		"removed":   ruleStrings(remove),
+	}, err)
+	if err != nil {
+		return nil, err
+	}
+	return &api_gen.UpdatePolicyResponse{}, nil
+}
+
+func (s *grpcServer) GetPolicy(ctx context.Context, req *api_gen.GetPolicyRequest) (*api_gen.GetPolicyResponse, error) {
+	if err := s.authorize(ctx, objectACL, describeAction); err != nil {
+		return nil, err
+	}
+	updater, err := s.policyUpdater()
+	if err != nil {
+		return nil, err
+	}
+	res := &api_gen.GetPolicyResponse{}
+	for _, rule := range updater.Policy() {
+		res.Rules = append(res.Rules, &api_gen.PolicyRule{
+			Ptype:  rule[0],
+			Values: rule[1:],
+		})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) policyUpdater() (PolicyUpdater, error) {
+	updater, ok := s.Authorizer.(PolicyUpdater)
+	if !ok {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"authorizer's policy can't be read or changed",
+		)
+	}
+	return updater, nil
+}
+
+// ruleStrings formats rules as lines of a policy file joined by semicolons.
+func ruleStrings(rules [][]string) string {
+	lines := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		lines = append(lines, strings.Join(rule, ", "))
+	}
+	return strings.Join(lines, "; ")
+}
+
+func policyRules(pbs []*api_gen.PolicyRule) [][]string {
+	rules := make([][]string, 0, len(pbs))
+	for _, pb := range pbs {
+		rules = append(rules, append([]string{pb.Ptype}, pb.Values...))
+	}
+	return rules
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/audit"
+)
+
+// auditedMetadata is the request metadata recorded with audit events. Other
+// metadata, such as credentials, isn't.
+var auditedMetadata = []string{"user-agent", "x-request-id", "traceparent"}
+
+// authorize authorizes the context's subject to take the action on the
+// object, auditing the decision.
+func (s *grpcServer) authorize(ctx context.Context, object, action string) error {
+	err := s.Authorizer.Authorize(subject(ctx), object, action)
+	if s.Auditor == nil {
+		return err
+	}
+	e := auditEvent(ctx, audit.Authorization, object, action)
+	e.Decision = audit.Allow
+	if err != nil {
+		e.Decision = audit.Deny
+		e.Error = err.Error()
+	}
+	e.Read = action == consumeAction || action == describeAction
+	s.Auditor.Record(e)
+	return err
+}
+
+// auditAdmin audits an admin operation on the object and its outcome.
+func (s *grpcServer) auditAdmin(
+	ctx context.Context,
+	object string,
+	details map[string]string,
+	err error,
+) {
+	if s.Auditor == nil {
+		return
+	}
+	e := auditEvent(ctx, audit.Admin, object, adminAction)
+	e.Details = details
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.Auditor.Record(e)
+}
+
+func auditEvent(ctx context.Context, typ, object, action string) audit.Event {
+	e := audit.Event{
+		Type:    typ,
+		Subject: subject(ctx),
+		Action:  action,
+		Object:  object,
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		e.Peer = p.Addr.String()
+	}
+	if method, ok := grpc.Method(ctx); ok {
+		e.Method = method
+	} else if method, ok := ctx.Value(httpRouteContextKey{}).(string); ok {
+		e.Method = method
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range auditedMetadata {
+		if v := md.Get(key); len(v) > 0 {
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]string)
+			}
+			e.Metadata[key] = v[0]
+		}
+	}
+	return e
+}
+
+type httpRouteContextKey struct{}
+
+// auditContext gives HTTP requests' contexts their method and path, and the
+// audited headers as incoming metadata, as gRPC requests' have.
+func auditContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md := metadata.MD{}
+		for _, key := range auditedMetadata {
+			if v := r.Header.Get(key); v != "" {
+				md.Set(key, v)
+			}
+		}
+		ctx := metadata.NewIncomingContext(r.Context(), md)
+		ctx = context.WithValue(ctx, httpRouteContextKey{}, r.Method+" "+r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"github.com/google/cel-go/cel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// filterCostLimit bounds the work a filter can do on each record so a
+// consumer can't tie up the server with an expensive expression.
+const filterCostLimit = 10000
+
+// filterEnv declares the record fields filters can use.
+var filterEnv = newFilterEnv()
+
+func newFilterEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("key", cel.BytesType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("timestamp", cel.TimestampType),
+		cel.Variable("offset", cel.UintType),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// recordFilter reports whether a record matches a consumer's filter.
+type recordFilter func(*api_gen.Record) bool
+
+// newRecordFilter compiles the CEL expression, returning nil if it's empty.
+// Records the filter fails to evaluate on, such as with a missing header,
+// don't match.
+func newRecordFilter(expr string) (recordFilter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	ast, issues := filterEnv.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"invalid filter: %s",
+			issues.Err(),
+		)
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"filter must be a bool, not %s",
+			ast.OutputType(),
+		)
+	}
+	prg, err := filterEnv.Program(ast, cel.CostLimit(filterCostLimit))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid filter: %s", err)
+	}
+	return func(record *api_gen.Record) bool {
+		out, _, err := prg.Eval(map[string]interface{}{
+			"key":       record.Key,
+			"headers":   headerMap(record.Headers),
+			"timestamp": record.Timestamp.AsTime(),
+			"offset":    record.Offset,
+		})
+		if err != nil {
+			return false
+		}
+		match, ok := out.Value().(bool)
+		return ok && match
+	}, nil
+}
+
+func (f recordFilter) match(record *api_gen.Record) bool {
+	return f == nil || f(record)
+}
+
+// headerMap returns the headers by key, keeping the last of repeated keys.
+func headerMap(headers []*api_gen.Header) map[string]string {
+	m := make(map[string]string, len(headers))
+	for _, h := range headers {
+		m[h.Key] = h.Value
+	}
+	return m
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// The health service reports these services besides the server as a whole,
+// "", and the Log service, which are serving when the node can serve reads.
+// Only the leader serves writes, so followers report LogWriteService as not
+// serving while otherwise healthy.
+var (
+	LogWriteService = api_gen.Log_ServiceDesc.ServiceName + ".write"
+	LogReadService  = api_gen.Log_ServiceDesc.ServiceName + ".read"
+)
+
+// HealthChecker is implemented by commit logs whose availability depends on
+// their cluster. Writes are served by the leader and reads by nodes that know
+// of a leader and have applied every committed record.
+type HealthChecker interface {
+	IsLeader() bool
+	HasLeader() bool
+	CaughtUp() bool
+}
+
+// healthWatchInterval is how often Watch checks for a change of status.
+var healthWatchInterval = time.Second
+
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	*Config
+}
+
+var _ healthpb.HealthServer = (*healthServer)(nil)
+
+func (s *healthServer) Check(
+	ctx context.Context,
+	req *healthpb.HealthCheckRequest,
+) (*healthpb.HealthCheckResponse, error) {
+	st, ok := s.status(req.Service)
+	if !ok {
+		return nil, status.Errorf(
+			codes.NotFound,
+			"unknown service: %s",
+			req.Service,
+		)
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch sends the service's status whenever it changes. The stream ends when
+// the server shuts down so it doesn't hold up a graceful stop.
+func (s *healthServer) Watch(
+	req *healthpb.HealthCheckRequest,
+	stream healthpb.Health_WatchServer,
+) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		st, ok := s.status(req.Service)
+		if !ok {
+			st = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		}
+		if st != last {
+			err := stream.Send(&healthpb.HealthCheckResponse{Status: st})
+			if err != nil {
+				return err
+			}
+			last = st
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.ShuttingDown:
+			if last != healthpb.HealthCheckResponse_NOT_SERVING {
+				return stream.Send(&healthpb.HealthCheckResponse{
+					Status: healthpb.HealthCheckResponse_NOT_SERVING,
+				})
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *healthServer) status(
+	service string,
+) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	var serving bool
+	switch service {
+	case "", api_gen.Log_ServiceDesc.ServiceName:
+		serving = s.canRead()
+	case LogWriteService:
+		serving = s.canWrite()
+	case LogReadService:
+		serving = s.canRead()
+	default:
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	if serving && !s.shuttingDown() {
+		return healthpb.HealthCheckResponse_SERVING, true
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING, true
+}
+
+func (s *healthServer) canWrite() bool {
+	checker, ok := s.CommitLog.(HealthChecker)
+	return !ok || checker.IsLeader()
+}
+
+func (s *healthServer) canRead() bool {
+	checker, ok := s.CommitLog.(HealthChecker)
+	return !ok || (checker.HasLeader() && checker.CaughtUp())
+}
+
+func (s *healthServer) shuttingDown() bool {
+	select {
+	case <-s.ShuttingDown:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,90 +1,437 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/authn"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/quota"
 )
 
-type ProduceRequest struct {
-	Record Record `json:"record"`
+// NewHTTPServer returns a server for the HTTP/JSON API, which calls the same
+// CommitLog, Authorizer and GetServerer as the gRPC server. Messages are the
+// gRPC API's encoded with protojson, so record values are base64:
+//
+//	POST /v1/records               produce a ProduceRequest
+//	GET  /v1/records/{offset}      consume a record
+//	GET  /v1/records?offset={n}    stream records from n as newline delimited JSON
+//	GET  /v1/records/events        stream records as server-sent events
+//	GET  /v1/records/ws            stream records over a WebSocket
+//	GET  /v1/servers               get the cluster's servers
+//	GET  /v1/offsets               get the log's offsets
+//	POST /v1/schemas               register a RegisterSchemaRequest
+//	GET  /v1/schemas/{subject}     get a schema, its latest or ?version={n}
+//	PUT  /v1/schemas/{subject}/compatibility
+//	                               apply a SetSchemaCompatibilityRequest
+//	POST /v1/acl/reload            reload the ACL policy from its file
+//	GET  /v1/acl                   get the ACL policy's rules
+//	POST /v1/acl                   apply an UpdatePolicyRequest
+//
+// Consume requests take an isolation query parameter, and streams an offset
+// to start from, either a number, "earliest", or "end" to tail new records,
+// and a CEL filter over the records' key, headers, timestamp and offset.
+// Server-sent events carry their record's offset as the event id, so clients
+// reconnecting with Last-Event-ID resume after the last record they got.
+// Clients are identified by their certificate or an Authorization bearer
+// token, as with gRPC.
+func NewHTTPServer(config *Config) (*http.Server, error) {
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+	h := &httpServer{grpcServer: srv}
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/records", h.handleProduce).Methods("POST")
+	r.HandleFunc("/v1/records/{offset:[0-9]+}", h.handleConsume).Methods("GET")
+	r.HandleFunc("/v1/records", h.handleConsumeStream).Methods("GET")
+	r.HandleFunc("/v1/records/events", h.handleEvents).Methods("GET")
+	r.HandleFunc("/v1/records/ws", h.handleWebSocket).Methods("GET")
+	r.HandleFunc("/v1/servers", h.handleGetServers).Methods("GET")
+	r.HandleFunc("/v1/offsets", h.handleGetOffsets).Methods("GET")
+	r.HandleFunc("/v1/schemas", h.handleRegisterSchema).Methods("POST")
+	r.HandleFunc("/v1/schemas/{subject}", h.handleGetSchema).Methods("GET")
+	r.HandleFunc("/v1/schemas/{subject}/compatibility", h.handleSetSchemaCompatibility).Methods("PUT")
+	r.HandleFunc("/v1/acl/reload", h.handleReloadACL).Methods("POST")
+	r.HandleFunc("/v1/acl", h.handleGetPolicy).Methods("GET")
+	r.HandleFunc("/v1/acl", h.handleUpdatePolicy).Methods("POST")
+	r.Use(auditContext, h.authenticateHTTP)
+	// there's no read or write timeout, which would cut off streams
+	readHeaderTimeout := config.HTTPReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = defaultHTTPReadHeaderTimeout
+	}
+	idleTimeout := config.HTTPIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultHTTPIdleTimeout
+	}
+	return &http.Server{
+		Handler:           r,
+		ConnContext:       connContext,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}, nil
 }
 
-type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
+type httpServer struct {
+	*grpcServer
 }
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
+	req := &api_gen.ProduceRequest{}
+	if !readJSON(w, r, req) {
+		return
+	}
+	if err := reserveQuota(r.Context(), s.Quotas, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := s.Produce(r.Context(), req)
+	writeJSON(w, res, err)
 }
 
-type ConsumeResponse struct {
-	Record Record `json:"record"`
+func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
+	req, ok := consumeRequest(w, r)
+	if !ok {
+		return
+	}
+	req.Offset, _ = strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err := reserveQuota(r.Context(), s.Quotas, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := s.Consume(r.Context(), req)
+	if err == nil {
+		chargeQuota(r.Context(), s.Quotas, res)
+	}
+	writeJSON(w, res, err)
 }
 
-type httpServer struct {
-	Log *Log
+func (s *httpServer) handleConsumeStream(w http.ResponseWriter, r *http.Request) {
+	req, release, ok := s.streamRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	stream := &httpConsumeStream{ctx: r.Context(), quotas: s.Quotas, send: func(_ *api_gen.ConsumeResponse, b []byte) error {
+		_, err := w.Write(append(b, '\n'))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return err
+	}}
+	_ = s.ConsumeStream(req, stream)
 }
 
-func newHTTPServer() *httpServer {
-	return &httpServer{
-		Log: NewLog(),
+// streamRequest returns the request for the stream r asks for, authorizing it
+// and counting it against the subject's quota before the stream starts so
+// failures get a status code. Call release when the stream ends.
+func (s *httpServer) streamRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+) (_ *api_gen.ConsumeRequest, release func(), _ bool) {
+	req, ok := consumeRequest(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if err := s.authorize(r.Context(), objectLog, consumeAction); err != nil {
+		writeError(w, err)
+		return nil, nil, false
+	}
+	req.Filter = r.URL.Query().Get("filter")
+	var err error
+	switch v := r.URL.Query().Get("offset"); v {
+	case "":
+	case "earliest":
+		req.Start = api_gen.StartPosition_START_POSITION_EARLIEST
+	case "end":
+		req.Start = api_gen.StartPosition_START_POSITION_LATEST
+	default:
+		req.Offset, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			err = status.Errorf(codes.InvalidArgument, "invalid offset: %s", v)
+		}
 	}
+	if err != nil {
+		writeError(w, err)
+		return nil, nil, false
+	}
+	release, err = openStream(r.Context(), s.Quotas)
+	if err != nil {
+		writeError(w, err)
+		return nil, nil, false
+	}
+	return req, release, true
 }
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsr := newHTTPServer()
-	r := mux.NewRouter()
-	r.HandleFunc("/", httpsr.handleProduce).Methods("POST")
-	r.HandleFunc("/", httpsr.handleConsume).Methods("GET")
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+func (s *httpServer) handleGetServers(w http.ResponseWriter, r *http.Request) {
+	if s.GetServerer == nil {
+		writeError(w, status.Error(codes.Unimplemented, "servers unavailable"))
+		return
 	}
+	res, err := s.GetServers(r.Context(), &api_gen.GetServersRequest{})
+	writeJSON(w, res, err)
+}
 
+func (s *httpServer) handleGetOffsets(w http.ResponseWriter, r *http.Request) {
+	res, err := s.GetOffsets(r.Context(), &api_gen.GetOffsetsRequest{})
+	writeJSON(w, res, err)
 }
 
-func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+func (s *httpServer) handleRegisterSchema(w http.ResponseWriter, r *http.Request) {
+	req := &api_gen.RegisterSchemaRequest{}
+	if !readJSON(w, r, req) {
 		return
 	}
-	off, err := s.Log.Append(req.Record)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	res, err := s.RegisterSchema(r.Context(), req)
+	writeJSON(w, res, err)
+}
+
+func (s *httpServer) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	req := &api_gen.GetSchemaRequest{Subject: mux.Vars(r)["subject"]}
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid version: %s", v))
+			return
+		}
+		req.Version = uint32(version)
+	}
+	res, err := s.GetSchema(r.Context(), req)
+	writeJSON(w, res, err)
+}
+
+// handleSetSchemaCompatibility takes the subject from the path rather than
+// the request.
+func (s *httpServer) handleSetSchemaCompatibility(w http.ResponseWriter, r *http.Request) {
+	req := &api_gen.SetSchemaCompatibilityRequest{}
+	if !readJSON(w, r, req) {
 		return
 	}
-	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	req.Subject = mux.Vars(r)["subject"]
+	res, err := s.SetSchemaCompatibility(r.Context(), req)
+	writeJSON(w, res, err)
+}
+
+func (s *httpServer) handleReloadACL(w http.ResponseWriter, r *http.Request) {
+	res, err := s.ReloadACL(r.Context(), &api_gen.ReloadACLRequest{})
+	writeJSON(w, res, err)
+}
+
+func (s *httpServer) handleGetPolicy(w http.ResponseWriter, r *http.Request) {
+	res, err := s.GetPolicy(r.Context(), &api_gen.GetPolicyRequest{})
+	writeJSON(w, res, err)
+}
+
+func (s *httpServer) handleUpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	req := &api_gen.UpdatePolicyRequest{}
+	if !readJSON(w, r, req) {
 		return
 	}
+	res, err := s.UpdatePolicy(r.Context(), req)
+	writeJSON(w, res, err)
 }
 
-func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	var req ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+// httpConsumeStream lets the gRPC ConsumeStream send records to an HTTP
+// stream, encoded with protojson, at the rate the subject's quota allows.
+type httpConsumeStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	quotas *quota.Manager
+	send   func(res *api_gen.ConsumeResponse, b []byte) error
+}
+
+func (s *httpConsumeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *httpConsumeStream) Send(res *api_gen.ConsumeResponse) error {
+	if records, bytes := consumed(res); records > 0 {
+		err := waitQuota(s.ctx, s.quotas, quota.Consume, records, bytes)
+		if err != nil {
+			return err
+		}
+	}
+	b, err := protojson.Marshal(res)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return err
 	}
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+	return s.send(res, b)
+}
+
+func consumeRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*api_gen.ConsumeRequest, bool) {
+	req := &api_gen.ConsumeRequest{}
+	if v := r.URL.Query().Get("isolation"); v != "" {
+		isolation, ok := api_gen.Isolation_value[v]
+		if !ok {
+			writeError(w, status.Errorf(
+				codes.InvalidArgument,
+				"unknown isolation: %s",
+				v,
+			))
+			return nil, false
+		}
+		req.Isolation = api_gen.Isolation(isolation)
+	}
+	return req, true
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, m proto.Message) bool {
+	b, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = protojson.Unmarshal(b, m)
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, m proto.Message, err error) {
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+	b, err := protojson.Marshal(m)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// writeError writes the error's gRPC status as JSON with the closest HTTP
+// status code, and a Retry-After header if it says when to retry.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	b, _ := protojson.Marshal(st.Proto())
+	for _, d := range st.Details() {
+		if retry, ok := d.(*errdetails.RetryInfo); ok {
+			secs := math.Ceil(retry.RetryDelay.AsDuration().Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	_, _ = w.Write(b)
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound, api.CodeOffsetOutOfRange:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+type tlsStateContextKey struct{}
+
+// connContext puts the connection's peer and TLS state in its context.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: conn.RemoteAddr()})
+	if state, ok := tlsState(conn); ok {
+		ctx = context.WithValue(ctx, tlsStateContextKey{}, &state)
+	}
+	return ctx
+}
+
+// authenticateHTTP puts the subject of the request's credentials in its
+// context.
+func (s *httpServer) authenticateHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var creds authn.Credentials
+		creds.TLS, _ = r.Context().Value(tlsStateContextKey{}).(*tls.ConnectionState)
+		creds.Token = authn.BearerToken(r.Header.Get("Authorization"))
+		ctx, err := s.authenticateCredentials(r.Context(), creds)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ServeHTTP serves srv on ln. TLS connections that negotiated HTTP/2 are
+// served with it, which http.Server only does when it terminates TLS itself.
+func ServeHTTP(srv *http.Server, ln net.Listener) error {
+	h2 := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		return err
+	}
+	return srv.Serve(&h2Listener{
+		Listener: ln,
+		serve: func(conn net.Conn) {
+			h2.ServeConn(conn, &http2.ServeConnOpts{
+				Context:    srv.ConnContext(context.Background(), conn),
+				BaseConfig: srv,
+				Handler:    srv.Handler,
+			})
+		},
+	})
+}
+
+// h2Listener hands connections that negotiated HTTP/2 to serve and returns
+// the rest from Accept.
+type h2Listener struct {
+	net.Listener
+	serve func(net.Conn)
+}
+
+func (l *h2Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if state, ok := tlsState(conn); ok && state.NegotiatedProtocol == http2.NextProtoTLS {
+			go l.serve(conn)
+			continue
+		}
+		return conn, nil
+	}
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// stamp sets the record's timestamp to now unless the producer set it, and
+// its append time to now regardless, which the log keeps from decreasing.
+func stamp(record *api_gen.Record) {
+	if record == nil {
+		return
+	}
+	now := timestamppb.Now()
+	if record.Timestamp == nil {
+		record.Timestamp = now
+	}
+	record.AppendTime = now
+}
+
+// startOffset returns the offset a ConsumeStream starts from.
+func (s *grpcServer) startOffset(req *api_gen.ConsumeRequest) (uint64, error) {
+	if req.Start == api_gen.StartPosition_START_POSITION_OFFSET {
+		return s.inRange(req.Offset, req.OutOfRange)
+	}
+	log, ok := s.CommitLog.(OffsetLog)
+	if !ok {
+		return 0, status.Errorf(
+			codes.Unimplemented,
+			"log doesn't support start position %s",
+			req.Start,
+		)
+	}
+	switch req.Start {
+	case api_gen.StartPosition_START_POSITION_EARLIEST:
+		return log.LowestOffset()
+	case api_gen.StartPosition_START_POSITION_LATEST:
+		return log.HighWatermark(), nil
+	case api_gen.StartPosition_START_POSITION_TIMESTAMP:
+		if req.StartTime == nil {
+			return 0, status.Error(
+				codes.InvalidArgument,
+				"start time is required to start from a timestamp",
+			)
+		}
+		return s.offsetAt(log, req.StartTime.AsTime())
+	}
+	return 0, status.Errorf(
+		codes.InvalidArgument,
+		"unknown start position: %s",
+		req.Start,
+	)
+}
+
+// inRange returns offset if the log has it or it's the high-water mark, the
+// next offset to be appended. Otherwise it applies the policy, either failing
+// or moving the offset to the start or end of the log.
+func (s *grpcServer) inRange(
+	offset uint64,
+	policy api_gen.OutOfRangePolicy,
+) (uint64, error) {
+	log, ok := s.CommitLog.(OffsetLog)
+	if !ok {
+		return offset, nil
+	}
+	lowest, err := log.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	hwm := log.HighWatermark()
+	if offset >= lowest && offset <= hwm {
+		return offset, nil
+	}
+	switch policy {
+	case api_gen.OutOfRangePolicy_OUT_OF_RANGE_RESET_EARLIEST:
+		return lowest, nil
+	case api_gen.OutOfRangePolicy_OUT_OF_RANGE_RESET_LATEST:
+		return hwm, nil
+	}
+	return 0, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
+// offsetAt returns the offset of the first record appended at or after t.
+// It searches by append time, which never decreases with offsets, rather than
+// timestamp, which producers can set. Records without an append time, which
+// were appended before it was kept, count as older than any time.
+func (s *grpcServer) offsetAt(log OffsetLog, t time.Time) (uint64, error) {
+	lo, err := log.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	hi := log.HighWatermark()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		record, err := s.CommitLog.Read(mid)
+		if err != nil {
+			return 0, err
+		}
+		if record.AppendTime == nil || record.AppendTime.AsTime().Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/quota"
+)
+
+// Quotas apply to the Log service's calls. Unary calls over quota fail with
+// ResourceExhausted and a RetryInfo saying when to retry, while streams are
+// slowed down to their quota. Consumers are charged for what they read, so a
+// consumer that reads past its quota waits before its next read.
+
+func quotaUnaryInterceptor(quotas *quota.Manager) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if !isLogMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		if err := reserveQuota(ctx, quotas, req); err != nil {
+			return nil, err
+		}
+		res, err := handler(ctx, req)
+		if err == nil {
+			chargeQuota(ctx, quotas, res)
+		}
+		return res, err
+	}
+}
+
+func quotaStreamInterceptor(quotas *quota.Manager) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if !isLogMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		release, err := openStream(ss.Context(), quotas)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return handler(srv, &quotaStream{ServerStream: ss, quotas: quotas})
+	}
+}
+
+func isLogMethod(method string) bool {
+	return strings.HasPrefix(method, "/"+api_gen.Log_ServiceDesc.ServiceName+"/")
+}
+
+// quotaStream waits for the subject's quota before taking each record it
+// receives and sending each record it's sent.
+type quotaStream struct {
+	grpc.ServerStream
+	quotas *quota.Manager
+}
+
+func (s *quotaStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if records, bytes := produced(m); records > 0 {
+		return waitQuota(s.Context(), s.quotas, quota.Produce, records, bytes)
+	}
+	return nil
+}
+
+func (s *quotaStream) SendMsg(m interface{}) error {
+	if records, bytes := consumed(m); records > 0 {
+		err := waitQuota(s.Context(), s.quotas, quota.Consume, records, bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// reserveQuota takes a produce request's records from the subject's quota, or
+// checks a consume request's subject hasn't read past its quota.
+func reserveQuota(ctx context.Context, quotas *quota.Manager, req interface{}) error {
+	if quotas == nil {
+		return nil
+	}
+	direction := quota.Produce
+	records, bytes := produced(req)
+	switch req.(type) {
+	case *api_gen.ConsumeRequest, *api_gen.ConsumeBatchRequest:
+		direction = quota.Consume
+	default:
+		if records == 0 {
+			return nil
+		}
+	}
+	sub := subject(ctx)
+	if delay := quotas.Reserve(sub, direction, records, bytes); delay > 0 {
+		return quotaExceeded(sub, "rate", delay)
+	}
+	return nil
+}
+
+// chargeQuota charges the subject for the records in a consume response.
+func chargeQuota(ctx context.Context, quotas *quota.Manager, res interface{}) {
+	if quotas == nil {
+		return
+	}
+	if records, bytes := consumed(res); records > 0 {
+		quotas.Charge(subject(ctx), quota.Consume, records, bytes)
+	}
+}
+
+func waitQuota(
+	ctx context.Context,
+	quotas *quota.Manager,
+	direction quota.Direction,
+	records, bytes int,
+) error {
+	if quotas == nil {
+		return nil
+	}
+	err := quotas.Wait(ctx, subject(ctx), direction, records, bytes)
+	if err != nil && ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if err != nil {
+		// the wait would outlast the stream's deadline
+		return quotaExceeded(subject(ctx), "rate", 0)
+	}
+	return nil
+}
+
+// openStream counts a stream against the subject's quota, returning a func to
+// call when it ends.
+func openStream(ctx context.Context, quotas *quota.Manager) (func(), error) {
+	if quotas == nil {
+		return func() {}, nil
+	}
+	release, ok := quotas.OpenStream(subject(ctx))
+	if !ok {
+		return nil, quotaExceeded(subject(ctx), "streams", 0)
+	}
+	return release, nil
+}
+
+// quotaExceeded returns a ResourceExhausted error naming the subject and the
+// quota it exceeded, saying when to retry if it's known.
+func quotaExceeded(subject, what string, retry time.Duration) error {
+	st := status.Newf(codes.ResourceExhausted, "%s exceeded its %s quota", subject, what)
+	failure := &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     subject,
+			Description: what,
+		}},
+	}
+	withDetails, err := st.WithDetails(failure)
+	if retry > 0 {
+		withDetails, err = st.WithDetails(failure, &errdetails.RetryInfo{
+			RetryDelay: durationpb.New(retry),
+		})
+	}
+	if err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// produced returns the records and bytes a produce request appends.
+func produced(req interface{}) (records, bytes int) {
+	var record *api_gen.Record
+	switch req := req.(type) {
+	case *api_gen.ProduceRequest:
+		record = req.Record
+	case *api_gen.ProduceTxnRequest:
+		record = req.Record
+	default:
+		return 0, 0
+	}
+	return 1, proto.Size(record)
+}
+
+// consumed returns the records and bytes in a consume response.
+func consumed(res interface{}) (records, bytes int) {
+	var batch []*api_gen.Record
+	switch res := res.(type) {
+	case *api_gen.ConsumeResponse:
+		batch = res.Records
+		if res.Record != nil {
+			batch = []*api_gen.Record{res.Record}
+		}
+	case *api_gen.ConsumeBatchResponse:
+		batch = res.Records
+	}
+	for _, record := range batch {
+		bytes += proto.Size(record)
+	}
+	return len(batch), bytes
+}
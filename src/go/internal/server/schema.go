@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// Records name the schema they're written with in these headers. Without a
+// version, records are validated against the subject's latest version.
+const (
+	schemaSubjectHeader = "schema-subject"
+	schemaVersionHeader = "schema-version"
+)
+
+// SchemaRegistry is implemented by commit logs that keep a registry of the
+// schemas records are written with.
+type SchemaRegistry interface {
+	RegisterSchema(*api_gen.RegisterSchemaRequest) (uint32, error)
+	SetSchemaCompatibility(*api_gen.SetSchemaCompatibilityRequest) error
+	GetSchema(subject string, version uint32) (*api_gen.Schema, error)
+	ValidateSchema(subject string, version uint32, value []byte) error
+}
+
+func (s *grpcServer) RegisterSchema(ctx context.Context, req *api_gen.RegisterSchemaRequest) (*api_gen.RegisterSchemaResponse, error) {
+	if err := s.authorize(ctx, schemaObject(req.Subject), adminAction); err != nil {
+		return nil, err
+	}
+	registry, err := s.schemaRegistry()
+	if err != nil {
+		return nil, err
+	}
+	version, err := registry.RegisterSchema(req)
+	details := map[string]string{"type": req.Type.String()}
+	if err == nil {
+		details["version"] = strconv.FormatUint(uint64(version), 10)
+	}
+	s.auditAdmin(ctx, schemaObject(req.Subject), details, err)
+	if err != nil {
+		return nil, err
+	}
+	return &api_gen.RegisterSchemaResponse{Version: version}, nil
+}
+
+// SetSchemaCompatibility sets the compatibility the subject's new schema
+// versions are checked with. It's an admin operation on the subject, as
+// registering is, and audited separately, since loosening it lets
+// incompatible versions be registered.
+func (s *grpcServer) SetSchemaCompatibility(ctx context.Context, req *api_gen.SetSchemaCompatibilityRequest) (*api_gen.SetSchemaCompatibilityResponse, error) {
+	if err := s.authorize(ctx, schemaObject(req.Subject), adminAction); err != nil {
+		return nil, err
+	}
+	registry, err := s.schemaRegistry()
+	if err != nil {
+		return nil, err
+	}
+	err = registry.SetSchemaCompatibility(req)
+	s.auditAdmin(ctx, schemaObject(req.Subject), map[string]string{
+		"compatibility": req.Compatibility.String(),
+	}, err)
+	if err != nil {
+		return nil, err
+	}
+	return &api_gen.SetSchemaCompatibilityResponse{}, nil
+}
+
+func (s *grpcServer) GetSchema(ctx context.Context, req *api_gen.GetSchemaRequest) (*api_gen.Schema, error) {
+	if err := s.authorize(ctx, schemaObject(req.Subject), describeAction); err != nil {
+		return nil, err
+	}
+	registry, err := s.schemaRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return registry.GetSchema(req.Subject, req.Version)
+}
+
+func (s *grpcServer) schemaRegistry() (SchemaRegistry, error) {
+	registry, ok := s.CommitLog.(SchemaRegistry)
+	if !ok {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"log doesn't have a schema registry",
+		)
+	}
+	return registry, nil
+}
+
+// validate returns an InvalidArgument error if the server enforces schemas and
+// the record doesn't name a schema or isn't valid with it.
+func (s *grpcServer) validate(record *api_gen.Record) error {
+	if !s.EnforceSchemas || record == nil {
+		return nil
+	}
+	registry, err := s.schemaRegistry()
+	if err != nil {
+		return err
+	}
+	var subject string
+	var version uint32
+	for _, h := range record.Headers {
+		switch h.Key {
+		case schemaSubjectHeader:
+			subject = h.Value
+		case schemaVersionHeader:
+			v, err := strconv.ParseUint(h.Value, 10, 32)
+			if err != nil || v == 0 {
+				return status.Errorf(
+					codes.InvalidArgument,
+					"invalid schema version: %s",
+					h.Value,
+				)
+			}
+			version = uint32(v)
+		}
+	}
+	if subject == "" {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"record has no %s header",
+			schemaSubjectHeader,
+		)
+	}
+	return registry.ValidateSchema(subject, version, record.Value)
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -13,28 +15,75 @@ import (
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
 
 	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/audit"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/authn"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/quota"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	objectWildcard = "*"
+	// objectLog is the log's records and objectACL the policy authorizing
+	// access to it. Each schema subject is its own object, named by
+	// schemaObject.
+	objectLog = "log"
+	objectACL = "acl"
+
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	describeAction = "describe"
+	adminAction    = "admin"
 )
 
+func schemaObject(subject string) string {
+	return "schemas/" + subject
+}
+
 type CommitLog interface {
 	Append(*api_gen.Record) (uint64, error)
 	Read(uint64) (*api_gen.Record, error)
 }
 
+// AsyncCommitLog is implemented by commit logs that append whole produce
+// requests, deduplicating retries by producer id and sequence, and that can
+// accept an append without waiting for it to commit, which lets ProduceStream
+// pipeline requests. Appends commit in the order they're submitted and the
+// returned func waits for the record's offset.
+type AsyncCommitLog interface {
+	ProduceAsync(context.Context, *api_gen.ProduceRequest) func() (uint64, error)
+}
+
+// TxnLog is implemented by commit logs that support transactions.
+type TxnLog interface {
+	BeginTxn() (uint64, error)
+	EndTxn(id uint64, commit bool) (uint64, error)
+	TxnState(id uint64) (open, aborted bool)
+}
+
+// OffsetLog is implemented by commit logs that report their bounds and their
+// high-water mark, the offset after their last record, which lets consumers
+// start at the end of the log and know how far behind they are.
+type OffsetLog interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	HighWatermark() uint64
+}
+
+// CommitIndexer is implemented by replicated commit logs.
+type CommitIndexer interface {
+	CommitIndex() (uint64, error)
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
@@ -44,11 +93,41 @@ type GetServerer interface {
 }
 
 type Config struct {
-	CommitLog   CommitLog
-	Authorizer  Authorizer
-	GetServerer GetServerer
+	CommitLog CommitLog
+	// Authenticator resolves clients' credentials to the subject Authorizer
+	// authorizes, their certificate's common name by default. Clients it
+	// can't identify are the anonymous subject "".
+	Authenticator authn.Authenticator
+	Authorizer    Authorizer
+	GetServerer   GetServerer
+	// ProduceWindow bounds how many of a ProduceStream's requests can be
+	// appending at once when the CommitLog is an AsyncCommitLog. One handles
+	// requests strictly one at a time.
+	ProduceWindow int
+	// ShuttingDown is closed when the server starts shutting down, after
+	// which the health service reports it as not serving.
+	ShuttingDown <-chan struct{}
+	// EnforceSchemas makes Produce reject records that don't name a schema
+	// in the CommitLog's SchemaRegistry or aren't valid with it.
+	EnforceSchemas bool
+	// Quotas limits each subject's throughput and streams when set.
+	Quotas *quota.Manager
+	// Auditor records authorization decisions and admin operations when set.
+	Auditor *audit.Auditor
+	// HTTPReadHeaderTimeout bounds how long the HTTP server waits for a
+	// request's headers, and HTTPIdleTimeout how long it keeps an idle
+	// connection open. Zero values keep the defaults.
+	HTTPReadHeaderTimeout time.Duration
+	HTTPIdleTimeout       time.Duration
 }
 
+const (
+	defaultProduceWindow = 64
+
+	defaultHTTPReadHeaderTimeout = 10 * time.Second
+	defaultHTTPIdleTimeout       = 2 * time.Minute
+)
+
 type grpcServer struct {
 	api_gen.UnimplementedLogServer
 	*Config
@@ -81,28 +160,34 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 		return nil, err
 	}
 
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+
 	opts = append(opts,
 		grpc.StreamInterceptor(
 			grpc_middleware.ChainStreamServer(
 				grpc_ctxtags.StreamServerInterceptor(),
 				grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-				grpc_auth.StreamServerInterceptor(authenticate),
+				grpc_auth.StreamServerInterceptor(srv.authenticate),
+				quotaStreamInterceptor(config.Quotas),
 			),
 		),
 		grpc.ChainUnaryInterceptor(
 			grpc_ctxtags.UnaryServerInterceptor(),
 			grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-			grpc_middleware.ChainUnaryServer(grpc_auth.UnaryServerInterceptor(authenticate)),
+			grpc_middleware.ChainUnaryServer(
+				grpc_auth.UnaryServerInterceptor(srv.authenticate),
+				quotaUnaryInterceptor(config.Quotas),
+			),
 		),
 		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
 	)
 
 	gsrv := grpc.NewServer(opts...)
-	srv, err := newgrpcServer(config)
-	if err != nil {
-		return nil, err
-	}
 	api_gen.RegisterLogServer(gsrv, srv)
+	healthpb.RegisterHealthServer(gsrv, &healthServer{Config: config})
 	return gsrv, nil
 }
 
@@ -110,11 +195,17 @@ func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
 		Config: config,
 	}
+	if _, ok := config.CommitLog.(SchemaRegistry); config.EnforceSchemas && !ok {
+		return nil, fmt.Errorf("enforcing schemas needs a log with a schema registry")
+	}
+	if srv.Authenticator == nil {
+		srv.Authenticator = authn.Certificate{}
+	}
 
 	return srv, nil
 }
 
-func authenticate(ctx context.Context) (context.Context, error) {
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
 		return ctx, status.New(
@@ -123,27 +214,49 @@ func authenticate(ctx context.Context) (context.Context, error) {
 		).Err()
 	}
 
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	var creds authn.Credentials
+	if info, ok := peer.AuthInfo.(credentials.TLSInfo); ok {
+		creds.TLS = &info.State
 	}
+	if v := metadata.ValueFromIncomingContext(ctx, "authorization"); len(v) > 0 {
+		creds.Token = authn.BearerToken(v[0])
+	}
+	return s.authenticateCredentials(ctx, creds)
+}
 
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-
-	return ctx, nil
+// authenticateCredentials puts the credentials' subject in the context.
+func (s *grpcServer) authenticateCredentials(
+	ctx context.Context,
+	creds authn.Credentials,
+) (context.Context, error) {
+	subject, _, err := s.Authenticator.Authenticate(creds)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return context.WithValue(ctx, subjectContextKey{}, subject), nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api_gen.ProduceRequest) (*api_gen.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	if err := s.authorize(ctx, objectLog, produceAction); err != nil {
 		return nil, err
 	}
+	return s.produce(ctx, req)
+}
 
-	offset, err := s.CommitLog.Append(req.Record)
+// produce appends the record for a producer that's been authorized.
+func (s *grpcServer) produce(ctx context.Context, req *api_gen.ProduceRequest) (*api_gen.ProduceResponse, error) {
+	if err := s.validate(req.Record); err != nil {
+		return nil, err
+	}
+	stamp(req.Record)
+	injectTrace(ctx, req.Record)
+	var offset uint64
+	var err error
+	if log, ok := s.CommitLog.(AsyncCommitLog); ok {
+		offset, err = log.ProduceAsync(ctx, req)()
+	} else {
+		offset, err = s.CommitLog.Append(req.Record)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -152,22 +265,167 @@ func (s *grpcServer) Produce(ctx context.Context, req *api_gen.ProduceRequest) (
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api_gen.ConsumeRequest) (*api_gen.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	if err := s.authorize(ctx, objectLog, consumeAction); err != nil {
 		return nil, err
 	}
+	return s.read(req)
+}
 
+// read reads the requested record for a consumer that's been authorized.
+func (s *grpcServer) read(req *api_gen.ConsumeRequest) (*api_gen.ConsumeResponse, error) {
 	record, err := s.CommitLog.Read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
-	return &api_gen.ConsumeResponse{Record: record}, nil
+	if req.Isolation == api_gen.Isolation_READ_COMMITTED {
+		if err = s.committed(record); err != nil {
+			return nil, err
+		}
+	}
+	return &api_gen.ConsumeResponse{
+		Record:        record,
+		HighWatermark: s.highWatermark(),
+	}, nil
+}
+
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api_gen.ConsumeBatchRequest) (*api_gen.ConsumeBatchResponse, error) {
+	if err := s.authorize(ctx, objectLog, consumeAction); err != nil {
+		return nil, err
+	}
+
+	var wait <-chan time.Time
+	if d := req.MaxWait.AsDuration(); req.MaxWait != nil && d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		wait = timer.C
+	}
+	for {
+		records, next, err := s.readBatch(
+			req.Offset,
+			req.Isolation,
+			req.MaxRecords,
+			req.MaxBytes,
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 || next != req.Offset || wait == nil {
+			return &api_gen.ConsumeBatchResponse{
+				Records:       records,
+				HighWatermark: s.highWatermark(),
+				NextOffset:    next,
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+			wait = nil
+		case <-time.After(batchPollInterval):
+		}
+	}
+}
+
+const (
+	defaultBatchRecords = 100
+	defaultBatchBytes   = 1 << 20
+	// batchPollInterval is how often a batch waiting for records checks for
+	// them.
+	batchPollInterval = 10 * time.Millisecond
+)
+
+// readBatch reads the records from offset up to the end of the log or the
+// limits, returning them and the offset to read the next batch from. The
+// batch always includes a record if there is one, even if it's larger than
+// maxBytes. Read committed batches skip records that won't commit and end at
+// the first record of an open transaction, and filtered batches skip records
+// that don't match.
+func (s *grpcServer) readBatch(
+	offset uint64,
+	isolation api_gen.Isolation,
+	maxRecords uint32,
+	maxBytes uint64,
+	filter recordFilter,
+) ([]*api_gen.Record, uint64, error) {
+	if maxRecords == 0 {
+		maxRecords = defaultBatchRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultBatchBytes
+	}
+	var records []*api_gen.Record
+	var size uint64
+	for uint32(len(records)) < maxRecords {
+		record, err := s.CommitLog.Read(offset)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok && s.pastEnd(offset) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if isolation == api_gen.Isolation_READ_COMMITTED {
+			err = s.committed(record)
+			if err, ok := err.(api.ErrRecordNotCommitted); ok {
+				if err.Open {
+					break
+				}
+				offset++
+				continue
+			}
+		}
+		if !filter.match(record) {
+			offset++
+			continue
+		}
+		size += uint64(proto.Size(record))
+		if len(records) > 0 && size > maxBytes {
+			break
+		}
+		records = append(records, record)
+		offset++
+	}
+	return records, offset, nil
+}
+
+// pastEnd reports whether offset is at or past the end of the log, as opposed
+// to before its start.
+func (s *grpcServer) pastEnd(offset uint64) bool {
+	log, ok := s.CommitLog.(OffsetLog)
+	return !ok || offset >= log.HighWatermark()
+}
+
+func (s *grpcServer) highWatermark() uint64 {
+	if log, ok := s.CommitLog.(OffsetLog); ok {
+		return log.HighWatermark()
+	}
+	return 0
+}
+
+// committed returns an api.ErrRecordNotCommitted if the record is a
+// transaction marker or belongs to a transaction that is open or aborted.
+func (s *grpcServer) committed(record *api_gen.Record) error {
+	if record.Marker != api_gen.TxnMarker_TXN_MARKER_NONE {
+		return api.ErrRecordNotCommitted{Offset: record.Offset}
+	}
+	if record.TxnId == 0 {
+		return nil
+	}
+	log, ok := s.CommitLog.(TxnLog)
+	if !ok {
+		return nil
+	}
+	open, aborted := log.TxnState(record.TxnId)
+	if open || aborted {
+		return api.ErrRecordNotCommitted{Offset: record.Offset, Open: open}
+	}
+	return nil
 }
 
 func (s *grpcServer) ProduceStream(stream api_gen.Log_ProduceStreamServer) error {
+	if log, ok := s.CommitLog.(AsyncCommitLog); ok && s.ProduceWindow != 1 {
+		return s.pipelineProduce(stream, log)
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
@@ -184,29 +442,207 @@ func (s *grpcServer) ProduceStream(stream api_gen.Log_ProduceStreamServer) error
 	}
 }
 
+// pipelineProduce submits requests as they arrive, keeping up to ProduceWindow
+// appends in flight, and answers them in order as they commit.
+func (s *grpcServer) pipelineProduce(
+	stream api_gen.Log_ProduceStreamServer,
+	log AsyncCommitLog,
+) error {
+	window := s.ProduceWindow
+	if window == 0 {
+		window = defaultProduceWindow
+	}
+	ctx := stream.Context()
+	slots := make(chan struct{}, window)
+	pending := make(chan func() (uint64, error), window)
+
+	var recvErr error
+	go func() {
+		defer close(pending)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr = err
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			pending <- s.produceAsync(ctx, log, req)
+		}
+	}()
+
+	for wait := range pending {
+		offset, err := wait()
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&api_gen.ProduceResponse{Offset: offset}); err != nil {
+			return err
+		}
+		<-slots
+	}
+	if recvErr == io.EOF {
+		return nil
+	}
+	return recvErr
+}
+
+func (s *grpcServer) produceAsync(
+	ctx context.Context,
+	log AsyncCommitLog,
+	req *api_gen.ProduceRequest,
+) func() (uint64, error) {
+	if err := s.authorize(ctx, objectLog, produceAction); err != nil {
+		return func() (uint64, error) { return 0, err }
+	}
+	if err := s.validate(req.Record); err != nil {
+		return func() (uint64, error) { return 0, err }
+	}
+	stamp(req.Record)
+	injectTrace(ctx, req.Record)
+	return log.ProduceAsync(ctx, req)
+}
+
 func (s *grpcServer) ConsumeStream(req *api_gen.ConsumeRequest, stream api_gen.Log_ConsumeStreamServer) error {
+	if err := s.authorize(stream.Context(), objectLog, consumeAction); err != nil {
+		return err
+	}
+	offset, err := s.startOffset(req)
+	if err != nil {
+		return err
+	}
+	req.Offset = offset
+	filter, err := newRecordFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	if req.MaxRecords > 0 {
+		return s.consumeBatchStream(req, stream, filter)
+	}
+	// skipped is whether records were filtered out since the last response,
+	// which the stream reports once it catches up with the log.
+	var skipped bool
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
+			res, err := s.read(req)
+			switch err := err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				offset, rangeErr := s.inRange(req.Offset, req.OutOfRange)
+				if rangeErr != nil {
+					return rangeErr
+				}
+				if offset != req.Offset {
+					req.Offset = offset
+					continue
+				}
+				if skipped {
+					rangeErr = stream.Send(&api_gen.ConsumeResponse{
+						HighWatermark: s.highWatermark(),
+						NextOffset:    offset,
+					})
+					if rangeErr != nil {
+						return rangeErr
+					}
+					skipped = false
+				}
+				// caught up with the log
+				if !waitForRecords(stream.Context()) {
+					return nil
+				}
+				continue
+			case api.ErrRecordNotCommitted:
+				if !err.Open {
+					req.Offset++
+					continue
+				}
+				// the record's transaction is still open
+				if !waitForRecords(stream.Context()) {
+					return nil
+				}
 				continue
 			default:
 				return err
 			}
 
+			if !filter.match(res.Record) {
+				skipped = true
+				req.Offset++
+				continue
+			}
+			res.NextOffset = req.Offset + 1
+			linkTraces(stream.Context(), res.Record)
 			if err = stream.Send(res); err != nil {
 				return err
 			}
+			skipped = false
 			req.Offset++
 		}
 	}
 }
 
+// waitForRecords waits batchPollInterval for records to be appended,
+// returning false if the context is done first.
+func waitForRecords(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(batchPollInterval):
+		return true
+	}
+}
+
+// consumeBatchStream sends records in batches as they're appended. Batches
+// that skipped every record they read are sent empty to report progress.
+func (s *grpcServer) consumeBatchStream(
+	req *api_gen.ConsumeRequest,
+	stream api_gen.Log_ConsumeStreamServer,
+	filter recordFilter,
+) error {
+	ctx := stream.Context()
+	offset := req.Offset
+	for {
+		records, next, err := s.readBatch(
+			offset,
+			req.Isolation,
+			req.MaxRecords,
+			req.MaxBytes,
+			filter,
+		)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			if offset, err = s.inRange(offset, req.OutOfRange); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 && next == offset {
+			if !waitForRecords(ctx) {
+				return nil
+			}
+			continue
+		}
+		offset = next
+		linkTraces(ctx, records...)
+		err = stream.Send(&api_gen.ConsumeResponse{
+			Records:       records,
+			HighWatermark: s.highWatermark(),
+			NextOffset:    next,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (s *grpcServer) GetServers(ctx context.Context, req *api_gen.GetServersRequest) (*api_gen.GetServersResponse, error) {
 	servers, err := s.GetServerer.GetServers()
 	if err != nil {
@@ -214,3 +650,94 @@ func (s *grpcServer) GetServers(ctx context.Context, req *api_gen.GetServersRequ
 	}
 	return &api_gen.GetServersResponse{Servers: servers}, nil
 }
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api_gen.GetOffsetsRequest) (*api_gen.GetOffsetsResponse, error) {
+	if err := s.authorize(ctx, objectLog, describeAction); err != nil {
+		return nil, err
+	}
+	log, ok := s.CommitLog.(OffsetLog)
+	if !ok {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"log doesn't report its offsets",
+		)
+	}
+	lowest, err := log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := log.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	res := &api_gen.GetOffsetsResponse{
+		LowestOffset:  lowest,
+		HighestOffset: highest,
+		HighWatermark: log.HighWatermark(),
+	}
+	if log, ok := s.CommitLog.(CommitIndexer); ok {
+		if res.CommitIndex, err = log.CommitIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (s *grpcServer) BeginTxn(ctx context.Context, req *api_gen.BeginTxnRequest) (*api_gen.BeginTxnResponse, error) {
+	log, err := s.txnLog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := log.BeginTxn()
+	if err != nil {
+		return nil, err
+	}
+	return &api_gen.BeginTxnResponse{TxnId: id}, nil
+}
+
+func (s *grpcServer) ProduceTxn(ctx context.Context, req *api_gen.ProduceTxnRequest) (*api_gen.ProduceResponse, error) {
+	if _, err := s.txnLog(ctx); err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		req.Record = &api_gen.Record{}
+	}
+	req.Record.TxnId = req.TxnId
+	return s.produce(ctx, &api_gen.ProduceRequest{Record: req.Record})
+}
+
+func (s *grpcServer) CommitTxn(ctx context.Context, req *api_gen.EndTxnRequest) (*api_gen.EndTxnResponse, error) {
+	return s.endTxn(ctx, req.TxnId, true)
+}
+
+func (s *grpcServer) AbortTxn(ctx context.Context, req *api_gen.EndTxnRequest) (*api_gen.EndTxnResponse, error) {
+	return s.endTxn(ctx, req.TxnId, false)
+}
+
+func (s *grpcServer) endTxn(ctx context.Context, id uint64, commit bool) (*api_gen.EndTxnResponse, error) {
+	log, err := s.txnLog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := log.EndTxn(id, commit)
+	if err != nil {
+		return nil, err
+	}
+	return &api_gen.EndTxnResponse{Offset: offset}, nil
+}
+
+// txnLog authorizes the subject to produce and returns the commit log if it
+// supports transactions.
+func (s *grpcServer) txnLog(ctx context.Context) (TxnLog, error) {
+	if err := s.authorize(ctx, objectLog, produceAction); err != nil {
+		return nil, err
+	}
+	log, ok := s.CommitLog.(TxnLog)
+	if !ok {
+		return nil, status.Error(
+			codes.Unimplemented,
+			"the log doesn't support transactions",
+		)
+	}
+	return log, nil
+}
@@ -1,27 +1,55 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 
 	api "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api/v1"
 	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/audit"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/auth"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/authn"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/config"
 	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/log"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/quota"
+	"github.com/ianwesleyarmstrong/distributed-services-with-go-pants/internal/schema"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var (
@@ -131,9 +159,18 @@ func testProduceConsumeStream(t *testing.T, client, _ api_gen.LogClient, config
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// records are stamped when they're produced and carry the
+			// produce request's trace context
+			require.NotNil(t, res.Record.Timestamp)
+			require.Equal(t, res.Record.Timestamp, res.Record.AppendTime)
+			require.Len(t, res.Record.Headers, 1)
+			require.Equal(t, "traceparent", res.Record.Headers[0].Key)
 			require.Equal(t, res.Record, &api_gen.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:      record.Value,
+				Offset:     uint64(i),
+				Timestamp:  res.Record.Timestamp,
+				AppendTime: res.Record.AppendTime,
+				Headers:    res.Record.Headers,
 			})
 		}
 	}
@@ -196,6 +233,168 @@ func testUnauthorized(t *testing.T, _, client api_gen.LogClient, config *Config)
 	}
 }
 
+func TestProduceStreamPipelined(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = &asyncLog{c.CommitLog.(*log.Log)}
+		c.ProduceWindow = 2
+	})
+	defer teardown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		err = stream.Send(&api_gen.ProduceRequest{
+			Record: &api_gen.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+// asyncLog submits appends from goroutines so they complete out of order
+// unless the server orders the responses.
+type asyncLog struct {
+	*log.Log
+}
+
+func (l *asyncLog) ProduceAsync(
+	ctx context.Context,
+	req *api_gen.ProduceRequest,
+) func() (uint64, error) {
+	type result struct {
+		offset uint64
+		err    error
+	}
+	off, err := l.Append(req.Record)
+	done := make(chan result, 1)
+	go func() {
+		time.Sleep(time.Duration(10-off%10) * time.Millisecond)
+		done <- result{off, err}
+	}()
+	return func() (uint64, error) {
+		r := <-done
+		return r.offset, r.err
+	}
+}
+
+func TestConsumeReadCommitted(t *testing.T) {
+	txns := &txnLog{open: map[uint64]bool{}, aborted: map[uint64]bool{}}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		txns.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = txns
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	produce := func(id uint64, value string) {
+		_, err := client.ProduceTxn(ctx, &api_gen.ProduceTxnRequest{
+			TxnId:  id,
+			Record: &api_gen.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+	begin := func() uint64 {
+		res, err := client.BeginTxn(ctx, &api_gen.BeginTxnRequest{})
+		require.NoError(t, err)
+		return res.TxnId
+	}
+
+	produce(0, "plain")
+	committed, aborted := begin(), begin()
+	produce(committed, "committed")
+	produce(aborted, "aborted")
+	_, err := client.AbortTxn(ctx, &api_gen.EndTxnRequest{TxnId: aborted})
+	require.NoError(t, err)
+	open := begin()
+	produce(open, "open")
+	_, err = client.CommitTxn(ctx, &api_gen.EndTxnRequest{TxnId: committed})
+	require.NoError(t, err)
+
+	_, err = client.Consume(ctx, &api_gen.ConsumeRequest{
+		Offset:    2,
+		Isolation: api_gen.Isolation_READ_COMMITTED,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Isolation: api_gen.Isolation_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	for _, want := range []string{"plain", "committed"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+
+	// records after an open transaction wait for it to end
+	_, err = client.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("after")},
+	})
+	require.NoError(t, err)
+	_, err = client.CommitTxn(ctx, &api_gen.EndTxnRequest{TxnId: open})
+	require.NoError(t, err)
+	for _, want := range []string{"open", "after"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, string(res.Record.Value))
+	}
+}
+
+// txnLog tracks transactions in memory and appends their markers to the log.
+type txnLog struct {
+	*log.Log
+	mu      sync.Mutex
+	next    uint64
+	open    map[uint64]bool
+	aborted map[uint64]bool
+	checks  int
+}
+
+func (l *txnLog) BeginTxn() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	l.open[l.next] = true
+	return l.next, nil
+}
+
+func (l *txnLog) EndTxn(id uint64, commit bool) (uint64, error) {
+	marker := api_gen.TxnMarker_TXN_MARKER_ABORT
+	if commit {
+		marker = api_gen.TxnMarker_TXN_MARKER_COMMIT
+	}
+	off, err := l.Append(&api_gen.Record{TxnId: id, Marker: marker})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.open, id)
+	l.aborted[id] = !commit
+	return off, err
+}
+
+func (l *txnLog) TxnState(id uint64) (open, aborted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checks++
+	return l.open[id], l.aborted[id]
+}
+
+func (l *txnLog) stateChecks() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checks
+}
+
 func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api_gen.LogClient, cfg *Config, teardown func()) {
 	t.Helper()
 
@@ -204,10 +403,11 @@ func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api_gen
 
 	newClient := func(crtPath, keyPath string) (*grpc.ClientConn, api_gen.LogClient, []grpc.DialOption) {
 		clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-			CertFile: crtPath,
-			KeyFile:  keyPath,
-			CAFile:   config.CAFile,
-			Server:   false,
+			CertFile:      crtPath,
+			KeyFile:       keyPath,
+			CAFile:        config.CAFile,
+			ServerAddress: "127.0.0.1",
+			Server:        false,
 		})
 
 		require.NoError(t, err)
@@ -302,3 +502,1081 @@ func setupTest(t *testing.T, fn func(*Config)) (rootClient, nobodyClient api_gen
 		}
 	}
 }
+
+func TestConsumeBatch(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	requireBatch := func(records []*api_gen.Record, from, n uint64) {
+		t.Helper()
+		require.Len(t, records, int(n))
+		for i, record := range records {
+			require.Equal(t, from+uint64(i), record.Offset)
+		}
+	}
+
+	res, err := client.ConsumeBatch(ctx, &api_gen.ConsumeBatchRequest{
+		Offset:     1,
+		MaxRecords: 2,
+	})
+	require.NoError(t, err)
+	requireBatch(res.Records, 1, 2)
+	require.Equal(t, uint64(3), res.NextOffset)
+	require.Equal(t, uint64(5), res.HighWatermark)
+
+	// a batch has a record even if it's over max bytes
+	res, err = client.ConsumeBatch(ctx, &api_gen.ConsumeBatchRequest{
+		MaxBytes: 1,
+	})
+	require.NoError(t, err)
+	requireBatch(res.Records, 0, 1)
+
+	// a batch at the end waits for records
+	start := time.Now()
+	res, err = client.ConsumeBatch(ctx, &api_gen.ConsumeBatchRequest{
+		Offset:  5,
+		MaxWait: durationpb.New(50 * time.Millisecond),
+	})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+	require.Equal(t, uint64(5), res.NextOffset)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		MaxRecords: 3,
+	})
+	require.NoError(t, err)
+	batch, err := stream.Recv()
+	require.NoError(t, err)
+	requireBatch(batch.Records, 0, 3)
+	require.Equal(t, uint64(5), batch.HighWatermark)
+	batch, err = stream.Recv()
+	require.NoError(t, err)
+	requireBatch(batch.Records, 3, 2)
+}
+
+func TestGetOffsets(t *testing.T) {
+	client, nobody, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	res, err := client.GetOffsets(ctx, &api_gen.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, res.LowestOffset, res.HighWatermark)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	res, err = client.GetOffsets(ctx, &api_gen.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowestOffset)
+	require.Equal(t, uint64(2), res.HighestOffset)
+	require.Equal(t, uint64(3), res.HighWatermark)
+
+	consume, err := client.Consume(ctx, &api_gen.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), consume.HighWatermark)
+
+	_, err = nobody.GetOffsets(ctx, &api_gen.GetOffsetsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAuthorizeActions(t *testing.T) {
+	policy, err := ioutil.TempFile("", "policy-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(policy.Name())
+	_, err = policy.WriteString(strings.Join([]string{
+		"p, producer, log, produce",
+		"p, consumer, log, consume",
+		"p, consumer, log, describe",
+		"p, consumer, schemas/orders, describe",
+		"p, admin, *, admin",
+		"p, admin, acl, describe",
+		"g, admin, producer",
+		"g, root, admin",
+		"g, nobody, consumer",
+	}, "\n"))
+	require.NoError(t, err)
+	require.NoError(t, policy.Close())
+
+	client, consumer, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = auth.New(config.ACLModelFile, policy.Name())
+		c.CommitLog = &schemaLog{c.CommitLog.(*log.Log), schema.NewRegistry()}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err = client.RegisterSchema(ctx, &api_gen.RegisterSchemaRequest{
+		Subject:    "orders",
+		Definition: `{"type": "object"}`,
+	})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// the producer-only admin can't read
+	_, err = client.Consume(ctx, &api_gen.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	// including streaming over HTTP
+	httpCfg := *cfg
+	httpCfg.Authenticator = subjectAuthenticator("root")
+	srv, err := NewHTTPServer(&httpCfg)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/records?offset=0", nil))
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	_, err = consumer.Consume(ctx, &api_gen.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = consumer.GetOffsets(ctx, &api_gen.GetOffsetsRequest{})
+	require.NoError(t, err)
+	_, err = consumer.GetSchema(ctx, &api_gen.GetSchemaRequest{Subject: "orders"})
+	require.NoError(t, err)
+
+	_, err = consumer.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = consumer.GetSchema(ctx, &api_gen.GetSchemaRequest{Subject: "payments"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = consumer.RegisterSchema(ctx, &api_gen.RegisterSchemaRequest{
+		Subject:    "orders",
+		Definition: `{"type": "object"}`,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = consumer.ReloadACL(ctx, &api_gen.ReloadACLRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = consumer.GetPolicy(ctx, &api_gen.GetPolicyRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// policies read from a file are changed by editing it
+	_, err = client.UpdatePolicy(ctx, &api_gen.UpdatePolicyRequest{
+		Add: []*api_gen.PolicyRule{{Ptype: "g", Values: []string{"nobody", "producer"}}},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	f, err := os.OpenFile(policy.Name(), os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("\ng, nobody, producer")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	reload, err := client.ReloadACL(ctx, &api_gen.ReloadACLRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"g, nobody, producer"}, reload.Added)
+	require.Empty(t, reload.Removed)
+	policyRes, err := client.GetPolicy(ctx, &api_gen.GetPolicyRequest{})
+	require.NoError(t, err)
+	require.Len(t, policyRes.Rules, 10)
+	_, err = consumer.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+}
+
+// subjectAuthenticator identifies every client as the subject.
+type subjectAuthenticator string
+
+func (a subjectAuthenticator) Authenticate(authn.Credentials) (string, bool, error) {
+	return string(a), true, nil
+}
+
+func TestConsumeStartPosition(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	produce := func(timestamp time.Time) {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value:     []byte("hello world"),
+				Timestamp: timestamppb.New(timestamp),
+			},
+		})
+		require.NoError(t, err)
+	}
+	// records are found by when they were appended rather than their
+	// producers' timestamps, which needn't increase
+	produce(start.Add(time.Hour))
+	time.Sleep(10 * time.Millisecond)
+	appended := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	produce(start.Add(-time.Hour))
+	produce(start)
+	first := func(req *api_gen.ConsumeRequest) (uint64, error) {
+		stream, err := client.ConsumeStream(ctx, req)
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		return res.Record.Offset, nil
+	}
+
+	off, err := first(&api_gen.ConsumeRequest{
+		Start: api_gen.StartPosition_START_POSITION_EARLIEST,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	off, err = first(&api_gen.ConsumeRequest{
+		Start:     api_gen.StartPosition_START_POSITION_TIMESTAMP,
+		StartTime: timestamppb.New(appended),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = first(&api_gen.ConsumeRequest{Offset: 10})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}), status.Code(err))
+
+	// the latest position and resetting to it only get new records
+	latest, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Start: api_gen.StartPosition_START_POSITION_LATEST,
+	})
+	require.NoError(t, err)
+	reset, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Offset:     10,
+		OutOfRange: api_gen.OutOfRangePolicy_OUT_OF_RANGE_RESET_LATEST,
+	})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	produce(time.Now())
+	for _, stream := range []api_gen.Log_ConsumeStreamClient{latest, reset} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), res.Record.Offset)
+	}
+}
+
+func TestConsumeFilter(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, key := range []string{"a", "b", "a", "b", "b"} {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{Key: []byte(key), Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Filter: `key == b"a"`,
+	})
+	require.NoError(t, err)
+	for _, want := range []uint64{0, 2} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+		require.Equal(t, want+1, res.NextOffset)
+	}
+	// the records skipped at the end of the log are reported as progress
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+	require.Equal(t, uint64(5), res.NextOffset)
+
+	batches, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Offset:     1,
+		MaxRecords: 10,
+		Filter:     `key == b"b" && offset > 1u`,
+	})
+	require.NoError(t, err)
+	res, err = batches.Recv()
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, uint64(3), res.Records[0].Offset)
+	require.Equal(t, uint64(4), res.Records[1].Offset)
+	require.Equal(t, uint64(5), res.NextOffset)
+
+	for _, filter := range []string{"key ==", "offset"} {
+		stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+			Filter: filter,
+		})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestRecordHeaders(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	for _, tenant := range []string{"acme", "initech"} {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{
+				Value: []byte("hello world"),
+				Headers: []*api_gen.Header{
+					{Key: "tenant", Value: tenant},
+					{Key: "traceparent", Value: traceparent},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Filter: `headers["tenant"] == "initech"`,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+	// the producer's trace context isn't replaced
+	require.Len(t, res.Record.Headers, 2)
+	require.Equal(t, "initech", res.Record.Headers[0].Value)
+	require.Equal(t, traceparent, res.Record.Headers[1].Value)
+}
+
+func TestSchemaEnforcement(t *testing.T) {
+	client, nobody, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = &schemaLog{
+			Log:      c.CommitLog.(*log.Log),
+			Registry: schema.NewRegistry(),
+		}
+		c.EnforceSchemas = true
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	res, err := client.RegisterSchema(ctx, &api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Definition: `{"type": "object", "required": ["name"]}`,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.Version)
+	got, err := client.GetSchema(ctx, &api_gen.GetSchemaRequest{Subject: "user"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), got.Version)
+	_, err = nobody.RegisterSchema(ctx, &api_gen.RegisterSchemaRequest{
+		Subject:    "user",
+		Definition: `{}`,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// incompatible versions are only registered once an admin loosens the
+	// subject's compatibility
+	_, err = client.RegisterSchema(ctx, &api_gen.RegisterSchemaRequest{
+		Subject:    "account",
+		Definition: `{"type": "object"}`,
+	})
+	require.NoError(t, err)
+	incompatible := &api_gen.RegisterSchemaRequest{
+		Subject:    "account",
+		Definition: `{"type": "string"}`,
+	}
+	_, err = client.RegisterSchema(ctx, incompatible)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	none := &api_gen.SetSchemaCompatibilityRequest{
+		Subject:       "account",
+		Compatibility: api_gen.Compatibility_COMPATIBILITY_NONE,
+	}
+	_, err = nobody.SetSchemaCompatibility(ctx, none)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.RegisterSchema(ctx, incompatible)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.SetSchemaCompatibility(ctx, none)
+	require.NoError(t, err)
+	res, err = client.RegisterSchema(ctx, incompatible)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), res.Version)
+
+	produce := func(value string, headers ...*api_gen.Header) error {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{Value: []byte(value), Headers: headers},
+		})
+		return err
+	}
+	user := &api_gen.Header{Key: "schema-subject", Value: "user"}
+	require.NoError(t, produce(`{"name": "ian"}`, user))
+	require.NoError(t, produce(`{"name": "ian"}`, user,
+		&api_gen.Header{Key: "schema-version", Value: "1"},
+	))
+	for _, err := range []error{
+		produce(`{}`, user),
+		produce(`{"name": "ian"}`),
+		produce(`{"name": "ian"}`, &api_gen.Header{Key: "schema-subject", Value: "group"}),
+		produce(`{"name": "ian"}`, user, &api_gen.Header{Key: "schema-version", Value: "2"}),
+	} {
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+// schemaLog keeps a schema registry in memory.
+type schemaLog struct {
+	*log.Log
+	*schema.Registry
+}
+
+func (l *schemaLog) RegisterSchema(req *api_gen.RegisterSchemaRequest) (uint32, error) {
+	return l.Register(req)
+}
+
+func (l *schemaLog) SetSchemaCompatibility(req *api_gen.SetSchemaCompatibilityRequest) error {
+	return l.SetCompatibility(req)
+}
+
+func (l *schemaLog) GetSchema(subject string, version uint32) (*api_gen.Schema, error) {
+	return l.Get(subject, version)
+}
+
+func (l *schemaLog) ValidateSchema(subject string, version uint32, value []byte) error {
+	return l.Validate(subject, version, value)
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwks, []byte(fmt.Sprintf(
+		`{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "1", "x": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(pub),
+	)), 0600))
+	tokens, err := authn.NewJWT(authn.JWTConfig{JWKSFile: jwks, Audience: "log"})
+	require.NoError(t, err)
+	exp := time.Now().Add(time.Hour).Unix()
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		token.Header["kid"] = "1"
+		s, err := token.SignedString(key)
+		require.NoError(t, err)
+		return s
+	}
+
+	_, client, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Authenticator = authn.Chain{tokens, authn.Certificate{}}
+	})
+	defer teardown()
+	produce := &api_gen.ProduceRequest{Record: &api_gen.Record{Value: []byte("hello world")}}
+
+	// the nobody client's token makes it root
+	root := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer "+sign(jwt.MapClaims{"sub": "root", "aud": "log", "exp": exp}))
+	_, err = client.Produce(root, produce)
+	require.NoError(t, err)
+
+	// without one it's identified by its certificate
+	_, err = client.Produce(context.Background(), produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	invalid := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer "+sign(jwt.MapClaims{"sub": "root", "aud": "other", "exp": exp}))
+	_, err = client.Produce(invalid, produce)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// HTTP clients without certificates can present tokens too
+	srv, err := NewHTTPServer(cfg)
+	require.NoError(t, err)
+	for token, code := range map[string]int{
+		"": http.StatusForbidden,
+		sign(jwt.MapClaims{"sub": "root", "aud": "log", "exp": exp}):  http.StatusOK,
+		sign(jwt.MapClaims{"sub": "root", "aud": "else", "exp": exp}): http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest("GET", "/v1/offsets", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, code, w.Code, w.Body.String())
+	}
+}
+
+func TestAudit(t *testing.T) {
+	sink := &memorySink{}
+	auditor := audit.New(audit.Config{ReadSampleRate: 0}, sink)
+	client, nobody, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Auditor = auditor
+		c.CommitLog = &schemaLog{c.CommitLog.(*log.Log), schema.NewRegistry()}
+	})
+	defer teardown()
+	ctx := metadata.AppendToOutgoingContext(
+		context.Background(),
+		"x-request-id", "42",
+		"authorization", "secret",
+	)
+
+	_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	// allowed reads aren't sampled at a zero rate, but denied ones are recorded
+	_, err = client.Consume(ctx, &api_gen.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = nobody.Consume(ctx, &api_gen.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.RegisterSchema(ctx, &api_gen.RegisterSchemaRequest{
+		Subject:    "orders",
+		Definition: `{"type": "object"}`,
+	})
+	require.NoError(t, err)
+
+	events := sink.wait(t, 4)
+	produce := events[0]
+	require.Equal(t, audit.Authorization, produce.Type)
+	require.Equal(t, "root", produce.Subject)
+	require.Equal(t, produceAction, produce.Action)
+	require.Equal(t, objectLog, produce.Object)
+	require.Equal(t, audit.Allow, produce.Decision)
+	require.Equal(t, "/"+api_gen.Log_ServiceDesc.ServiceName+"/Produce", produce.Method)
+	require.NotEmpty(t, produce.Peer)
+	require.Equal(t, "42", produce.Metadata["x-request-id"])
+	require.NotContains(t, produce.Metadata, "authorization")
+
+	denied := events[1]
+	require.Equal(t, "nobody", denied.Subject)
+	require.Equal(t, consumeAction, denied.Action)
+	require.Equal(t, audit.Deny, denied.Decision)
+	require.NotEmpty(t, denied.Error)
+
+	require.Equal(t, audit.Authorization, events[2].Type)
+	register := events[3]
+	require.Equal(t, audit.Admin, register.Type)
+	require.Equal(t, schemaObject("orders"), register.Object)
+	require.Equal(t, "1", register.Details["version"])
+	require.Empty(t, register.Error)
+
+	// HTTP requests are audited with their route and headers
+	srv, err := NewHTTPServer(cfg)
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/v1/offsets", nil)
+	req.Header.Set("X-Request-Id", "43")
+	srv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	events = sink.wait(t, 5)
+	require.Equal(t, "GET /v1/offsets", events[4].Method)
+	require.Equal(t, "43", events[4].Metadata["x-request-id"])
+	require.Equal(t, audit.Deny, events[4].Decision)
+}
+
+func TestConsumeStreamAuditedOnce(t *testing.T) {
+	sink := &memorySink{}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Auditor = audit.New(audit.Config{ReadSampleRate: 1}, sink)
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	// a caught up stream isn't authorized, or audited, again
+	time.Sleep(100 * time.Millisecond)
+	events := sink.list()
+	require.Len(t, events, 2)
+	require.Equal(t, consumeAction, events[1].Action)
+}
+
+func TestProduceTxnAuditedOnce(t *testing.T) {
+	sink := &memorySink{}
+	txns := &txnLog{open: map[uint64]bool{}, aborted: map[uint64]bool{}}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Auditor = audit.New(audit.Config{}, sink)
+		txns.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = txns
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	begin, err := client.BeginTxn(ctx, &api_gen.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = client.ProduceTxn(ctx, &api_gen.ProduceTxnRequest{
+		TxnId:  begin.TxnId,
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	// one authorization to begin and one to produce, not another for the
+	// record the transaction produces
+	time.Sleep(100 * time.Millisecond)
+	events := sink.wait(t, 2)
+	require.Equal(t, "/"+api_gen.Log_ServiceDesc.ServiceName+"/ProduceTxn", events[1].Method)
+}
+
+func TestConsumeStreamWaitsWhenCaughtUp(t *testing.T) {
+	var l *countingLog
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		l = &countingLog{Log: c.CommitLog.(*log.Log)}
+		c.CommitLog = l
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Start: api_gen.StartPosition_START_POSITION_LATEST,
+	})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	// about one read a poll interval rather than as many as it can
+	require.Less(t, l.reads(), int64(200*time.Millisecond/batchPollInterval)*2)
+
+	_, err = client.Produce(ctx, &api_gen.ProduceRequest{
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
+
+func TestConsumeStreamWaitsForOpenTxn(t *testing.T) {
+	txns := &txnLog{open: map[uint64]bool{}, aborted: map[uint64]bool{}}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		txns.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = txns
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	begin, err := client.BeginTxn(ctx, &api_gen.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = client.ProduceTxn(ctx, &api_gen.ProduceTxnRequest{
+		TxnId:  begin.TxnId,
+		Record: &api_gen.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{
+		Isolation: api_gen.Isolation_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	// about one check a poll interval rather than as many as it can
+	require.Less(t, txns.stateChecks(), int(200*time.Millisecond/batchPollInterval)*2)
+
+	_, err = client.CommitTxn(ctx, &api_gen.EndTxnRequest{TxnId: begin.TxnId})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
+
+type countingLog struct {
+	*log.Log
+	n atomic.Int64
+}
+
+func (l *countingLog) Read(off uint64) (*api_gen.Record, error) {
+	l.n.Add(1)
+	return l.Log.Read(off)
+}
+
+func (l *countingLog) reads() int64 {
+	return l.n.Load()
+}
+
+type memorySink struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (s *memorySink) Append(b []byte) error {
+	var e audit.Event
+	if err := json.Unmarshal(b, &e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memorySink) list() []audit.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]audit.Event(nil), s.events...)
+}
+
+// wait returns the events once n have been recorded, since the auditor writes
+// them in the background.
+func (s *memorySink) wait(t *testing.T, n int) []audit.Event {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return len(s.list()) >= n
+	}, time.Second, 10*time.Millisecond)
+	events := s.list()
+	require.Len(t, events, n)
+	return events
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestQuotas(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Quotas = quota.New(quota.Config{
+			Default: quota.Quota{ProduceRecordsPerSecond: 2, Streams: 1},
+		})
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	produce := func() error {
+		_, err := client.Produce(ctx, &api_gen.ProduceRequest{
+			Record: &api_gen.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+	require.NoError(t, produce())
+	require.NoError(t, produce())
+	err := produce()
+	st := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if d, ok := d.(*errdetails.RetryInfo); ok {
+			retry = d
+		}
+	}
+	require.NotNil(t, retry)
+	require.Greater(t, retry.RetryDelay.AsDuration(), time.Duration(0))
+
+	// a subject's second stream is refused while its first is open
+	stream, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	second, err := client.ConsumeStream(ctx, &api_gen.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = second.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	checker := &healthLog{Log: clog}
+	shutdown := make(chan struct{})
+	srv, err := NewGRPCServer(&Config{
+		CommitLog:    checker,
+		Authorizer:   auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		ShuttingDown: shutdown,
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	requireStatus := func(service string, want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		require.Equal(t, want, res.Status)
+	}
+	serving := healthpb.HealthCheckResponse_SERVING
+	notServing := healthpb.HealthCheckResponse_NOT_SERVING
+
+	requireStatus("", notServing)
+
+	checker.set(false, true, true)
+	requireStatus("", serving)
+	requireStatus(LogReadService, serving)
+	requireStatus(LogWriteService, notServing)
+
+	checker.set(true, true, false)
+	requireStatus(LogReadService, notServing)
+	requireStatus(LogWriteService, serving)
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	checker.set(true, true, true)
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, serving, res.Status)
+
+	// shutting down fails every check and ends watches
+	close(shutdown)
+	requireStatus(LogWriteService, notServing)
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, notServing, res.Status)
+	_, err = watch.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+type healthLog struct {
+	*log.Log
+	mu                          sync.Mutex
+	leader, hasLeader, caughtUp bool
+}
+
+func (l *healthLog) set(leader, hasLeader, caughtUp bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leader, l.hasLeader, l.caughtUp = leader, hasLeader, caughtUp
+}
+
+func (l *healthLog) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+func (l *healthLog) HasLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.hasLeader
+}
+
+func (l *healthLog) CaughtUp() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.caughtUp
+}
+
+func TestHTTPServer(t *testing.T) {
+	url, newClient, _ := setupHTTPTest(t)
+
+	for _, h2 := range []bool{false, true} {
+		client := newClient(config.RootClientCertFile, config.RootClientKeyFile, h2)
+		res, err := client.Post(
+			url+"/v1/records",
+			"application/json",
+			strings.NewReader(`{"record": {"value": "aGVsbG8gd29ybGQ="}}`),
+		)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, h2, res.ProtoMajor == 2)
+		produce := &api_gen.ProduceResponse{}
+		requireJSON(t, res, produce)
+
+		res, err = client.Get(fmt.Sprintf("%s/v1/records/%d", url, produce.Offset))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		consume := &api_gen.ConsumeResponse{}
+		requireJSON(t, res, consume)
+		require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+		res, err = client.Get(fmt.Sprintf("%s/v1/records/%d", url, produce.Offset+1))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+		res.Body.Close()
+	}
+
+	// records stream as newline delimited JSON
+	client := newClient(config.RootClientCertFile, config.RootClientKeyFile, false)
+	res, err := client.Get(url + "/v1/records?offset=0")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	scanner := bufio.NewScanner(res.Body)
+	for i := uint64(0); i < 2; i++ {
+		require.True(t, scanner.Scan())
+		consume := &api_gen.ConsumeResponse{}
+		require.NoError(t, protojson.Unmarshal(scanner.Bytes(), consume))
+		require.Equal(t, i, consume.Record.Offset)
+	}
+	res.Body.Close()
+
+	// the log has no schema registry
+	res, err = client.Get(url + "/v1/schemas/user")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotImplemented, res.StatusCode)
+	res.Body.Close()
+
+	client = newClient(config.NobodyClientCertFile, config.NobodyClientKeyFile, false)
+	res, err = client.Get(url + "/v1/records/0")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestHTTPTail(t *testing.T) {
+	url, newClient, clog := setupHTTPTest(t)
+	client := newClient(config.RootClientCertFile, config.RootClientKeyFile, false)
+	for i := 0; i < 2; i++ {
+		_, err := clog.Append(&api_gen.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	events := func(query, lastEventID string) *bufio.Reader {
+		req, err := http.NewRequest("GET", url+"/v1/records/events"+query, nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { res.Body.Close() })
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+		return bufio.NewReader(res.Body)
+	}
+	requireEvent := func(r *bufio.Reader, offset uint64) {
+		t.Helper()
+		id, err := r.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("id: %d\n", offset), id)
+		data, err := r.ReadString('\n')
+		require.NoError(t, err)
+		consume := &api_gen.ConsumeResponse{}
+		require.NoError(t, protojson.Unmarshal(
+			[]byte(strings.TrimPrefix(data, "data: ")),
+			consume,
+		))
+		require.Equal(t, offset, consume.Record.Offset)
+		_, err = r.ReadString('\n')
+		require.NoError(t, err)
+	}
+
+	r := events("?offset=0", "")
+	requireEvent(r, 0)
+	requireEvent(r, 1)
+
+	// reconnecting resumes after the last event
+	r = events("?offset=0", "0")
+	requireEvent(r, 1)
+
+	// tailing from the end only gets new records
+	tail := events("?offset=end", "")
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	dialer := &websocket.Dialer{TLSClientConfig: tlsConfig}
+	ws, _, err := dialer.Dial(
+		"wss"+strings.TrimPrefix(url, "https")+"/v1/records/ws?offset=1",
+		nil,
+	)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	_, err = clog.Append(&api_gen.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	requireEvent(tail, 2)
+	for off := uint64(1); off < 3; off++ {
+		_, b, err := ws.ReadMessage()
+		require.NoError(t, err)
+		consume := &api_gen.ConsumeResponse{}
+		require.NoError(t, protojson.Unmarshal(b, consume))
+		require.Equal(t, off, consume.Record.Offset)
+	}
+
+	client = newClient(config.NobodyClientCertFile, config.NobodyClientKeyFile, false)
+	res, err := client.Get(url + "/v1/records/events")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res.Body.Close()
+}
+
+// setupHTTPTest serves the HTTP API over TLS, returning its URL and a func
+// for making clients with a certificate.
+func TestHTTPServerTimeouts(t *testing.T) {
+	srv, err := NewHTTPServer(&Config{})
+	require.NoError(t, err)
+	require.Equal(t, defaultHTTPReadHeaderTimeout, srv.ReadHeaderTimeout)
+	require.Equal(t, defaultHTTPIdleTimeout, srv.IdleTimeout)
+	// streams aren't cut off
+	require.Zero(t, srv.ReadTimeout)
+	require.Zero(t, srv.WriteTimeout)
+
+	srv, err = NewHTTPServer(&Config{
+		HTTPReadHeaderTimeout: time.Second,
+		HTTPIdleTimeout:       time.Minute,
+	})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, srv.ReadHeaderTimeout)
+	require.Equal(t, time.Minute, srv.IdleTimeout)
+}
+
+func setupHTTPTest(t *testing.T) (
+	url string,
+	newClient func(crtPath, keyPath string, h2 bool) *http.Client,
+	clog *log.Log,
+) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	clog, err = log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	srv, err := NewHTTPServer(&Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+	})
+	require.NoError(t, err)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	serverTLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go ServeHTTP(srv, tls.NewListener(l, serverTLSConfig))
+	t.Cleanup(func() { srv.Close() })
+
+	newClient = func(crtPath, keyPath string, h2 bool) *http.Client {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      crtPath,
+			KeyFile:       keyPath,
+			CAFile:        config.CAFile,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: h2,
+		}}
+	}
+	return "https://" + l.Addr().String(), newClient, clog
+}
+
+func requireJSON(t *testing.T, res *http.Response, m proto.Message) {
+	t.Helper()
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, protojson.Unmarshal(b, m))
+}
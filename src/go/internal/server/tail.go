@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// handleEvents streams records as server-sent events. Events reporting
+// progress past filtered records carry the last offset skipped as their id.
+func (s *httpServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	req, release, ok := s.streamRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		req.Offset = last + 1
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := &httpConsumeStream{ctx: r.Context(), quotas: s.Quotas, send: func(res *api_gen.ConsumeResponse, b []byte) error {
+		_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", res.NextOffset-1, b)
+		flusher.Flush()
+		return err
+	}}
+	_ = s.ConsumeStream(req, stream)
+}
+
+// handleWebSocket streams records over a WebSocket, one record per text
+// message. Messages from the client are ignored; the stream ends when the
+// client closes the connection.
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	req, release, ok := s.streamRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	stream := &httpConsumeStream{ctx: ctx, quotas: s.Quotas, send: func(_ *api_gen.ConsumeResponse, b []byte) error {
+		return conn.WriteMessage(websocket.TextMessage, b)
+	}}
+	err = s.ConsumeStream(req, stream)
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err != nil {
+		msg = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, msg)
+}
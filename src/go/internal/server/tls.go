@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc/credentials"
+)
+
+// TerminatedTLS returns credentials for a gRPC server whose listener has
+// already terminated TLS, as when TLS connections are split between gRPC and
+// HTTP by a cmux. The connection's TLS state is passed on so clients are still
+// identified by their certificates.
+func TerminatedTLS() credentials.TransportCredentials {
+	return terminatedTLS{}
+}
+
+type terminatedTLS struct{}
+
+func (terminatedTLS) ServerHandshake(
+	conn net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	state, ok := tlsState(conn)
+	if !ok {
+		return nil, nil, errNotTLS
+	}
+	return conn, credentials.TLSInfo{
+		State: state,
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+	}, nil
+}
+
+func (terminatedTLS) ClientHandshake(
+	context.Context,
+	string,
+	net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errNotTLS
+}
+
+func (terminatedTLS) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls"}
+}
+
+func (c terminatedTLS) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (terminatedTLS) OverrideServerName(string) error {
+	return nil
+}
+
+var errNotTLS = errors.New("connection isn't a terminated TLS connection")
+
+// tlsState returns the state of the TLS connection conn wraps, completing the
+// handshake if it hasn't been.
+func tlsState(conn net.Conn) (tls.ConnectionState, bool) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			if err := c.Handshake(); err != nil {
+				return tls.ConnectionState{}, false
+			}
+			return c.ConnectionState(), true
+		case *cmux.MuxConn:
+			conn = c.Conn
+		default:
+			return tls.ConnectionState{}, false
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+
+	api_gen "github.com/ianwesleyarmstrong/distributed-services-with-go-pants/api_gen/v1"
+)
+
+// The W3C trace context headers.
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+var traceFormat = &tracecontext.HTTPFormat{}
+
+// injectTrace adds the trace context of ctx's span to the record's headers,
+// unless the producer propagated a trace context of its own.
+func injectTrace(ctx context.Context, record *api_gen.Record) {
+	span := trace.FromContext(ctx)
+	if record == nil || span == nil {
+		return
+	}
+	for _, h := range record.Headers {
+		if h.Key == traceparentHeader {
+			return
+		}
+	}
+	req := &http.Request{Header: http.Header{}}
+	traceFormat.SpanContextToRequest(span.SpanContext(), req)
+	for _, key := range []string{traceparentHeader, tracestateHeader} {
+		if v := req.Header.Get(key); v != "" {
+			record.Headers = append(record.Headers, &api_gen.Header{
+				Key:   key,
+				Value: v,
+			})
+		}
+	}
+}
+
+// extractTrace returns the trace context in the record's headers.
+func extractTrace(record *api_gen.Record) (trace.SpanContext, bool) {
+	req := &http.Request{Header: http.Header{}}
+	for _, h := range record.Headers {
+		if h.Key == traceparentHeader || h.Key == tracestateHeader {
+			req.Header.Add(h.Key, h.Value)
+		}
+	}
+	return traceFormat.SpanContextFromRequest(req)
+}
+
+// linkTraces links the span of ctx, the consumer's, to the traces the records
+// were produced in, so traces can be followed from producer to consumer.
+func linkTraces(ctx context.Context, records ...*api_gen.Record) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		if sc, ok := extractTrace(record); ok {
+			span.AddLink(trace.Link{
+				TraceID: sc.TraceID,
+				SpanID:  sc.SpanID,
+				Type:    trace.LinkTypeParent,
+			})
+		}
+	}
+}